@@ -18,8 +18,10 @@ package v1alpha1
 
 import (
 	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // Grammar:
@@ -27,33 +29,220 @@ import (
 // top := templateExpr forExpr+
 
 // templateExpr := "template": template
+//               | "templates": ("name": name "when": CELexpr? "template": template)+
 //
-// forExpr := "var": var
-//            "in": generator
+// forExpr := (("var": var | "vars": var+)
+//             "in": generator
+//            | "zip": ("var": var "in": generator)+
+//            | "let": var "value": template)
 //            "when": CELexpr
 //
 // var := DNSLABEL
 //
-// generator := "list" object*
-//           | "query" apiVersion kind name|matchLabels
+// generator := "list" (object* | object | CELexpr)
+//           | "query" apiVersion kind name|(matchLabels matchExpressions fieldSelector)
+//           | "range" start? end step?
+//           | "git" url ref? (directories|files)
+//           | "source" kind name (directories|files)
+//           | ("configMap"|"secret") name format?
 //        // | others TBD
 //
 // template := k8sTemplate+ /* { TypeMeta... } */
 
 type ForExpr struct {
-	Var  string    `json:"var"`
-	In   Generator `json:"in"`
-	When string    `json:"when,omitempty"`
+	// Var is the name to bind each value to. Exactly one of Var and
+	// Vars must be given.
+	// +optional
+	Var string `json:"var,omitempty"`
+	// Vars are names to bind the parts of each value to. A list value
+	// is destructured by position, so it must have as many items as
+	// there are names; and an object value has the fields of the same
+	// names bound.
+	// +optional
+	Vars []string `json:"vars,omitempty"`
+	// In is the generator for the values to bind. It must be given,
+	// unless Zip is.
+	// +optional
+	In Generator `json:"in,omitempty"`
+	// Zip gives generators to advance together, in place of Var, Vars
+	// and In. Each value from a generator is bound to its variable,
+	// alongside the values at the same position from the other
+	// generators; and this stops when any of the generators runs out.
+	// +optional
+	Zip []ZipItem `json:"zip,omitempty"`
+	// Let is a name to bind to Value, in place of Var, Vars, and In
+	// or Zip. It's evaluated once each time around, so it can be used
+	// to name a value derived from earlier variables, rather than
+	// repeating the expression wherever the value is needed.
+	// +optional
+	Let string `json:"let,omitempty"`
+	// Value is the value to bind to Let. It's a template, so it can
+	// be a single expression, e.g., `${app.name + "-" + env}`, or
+	// an object or list with expressions within.
+	// +optional
+	Value *apiextensions.JSON `json:"value,omitempty"`
+	When  string              `json:"when,omitempty"`
+}
+
+// ZipItem is one of the generators in a zip.
+type ZipItem struct {
+	Var string    `json:"var"`
+	In  Generator `json:"in"`
 }
 
 type TemplateExpr struct {
+	// Template is instantiated for each combination of values from the
+	// for clauses. Exactly one of Template and Templates must be
+	// given. An object anywhere in a template can have a field `$if`,
+	// with an expression as its value; when the expression is false,
+	// the object is left out. To leave out a value that isn't an
+	// object, wrap it as `{$if: <expr>, $value: <value>}`, which is
+	// replaced with the value when the expression is true. An object
+	// can also have a field `$merge`, giving an object (or list of objects) whose fields are
+	// merged into it; and a list can have an item `{$splice: <list>}`,
+	// which is replaced with the items of the list (and which can
+	// have an `$if` too). A field left out by `$if` doesn't override
+	// a merged field of the same name.
+	// +optional
 	Template *apiextensions.JSON `json:"template,omitempty"`
+	// Templates are each instantiated in turn, for each combination of
+	// values from the for clauses; e.g., to give a Deployment and a
+	// Service for each app. The objects from each template are counted
+	// separately in the status.
+	// +optional
+	Templates []NamedTemplate `json:"templates,omitempty"`
+}
+
+// NamedTemplate is one of several templates to yield.
+type NamedTemplate struct {
+	// Name identifies the template in the status and in errors.
+	Name string `json:"name"`
+	// When is an expression which, if it evaluates to false, means
+	// this template is skipped for a combination of values.
+	// +optional
+	When     string              `json:"when,omitempty"`
+	Template *apiextensions.JSON `json:"template"`
 }
 
 type Generator struct {
-	List    *apiextensions.JSON `json:"list,omitempty"`
-	Query   *ObjectQuery        `json:"query,omitempty"`
-	Request *HttpRequest        `json:"request,omitempty"`
+	// List is a list of values to generate; or an object, in which
+	// case each entry is generated as a `[key, value]` pair, in order
+	// of key; or an expression evaluating to either of those.
+	List      *apiextensions.JSON `json:"list,omitempty"`
+	Query     *ObjectQuery        `json:"query,omitempty"`
+	Request   *HttpRequest        `json:"request,omitempty"`
+	Range     *Range              `json:"range,omitempty"`
+	Git       *GitRepository      `json:"git,omitempty"`
+	Source    *SourceArtifact     `json:"source,omitempty"`
+	ConfigMap *ObjectData         `json:"configMap,omitempty"`
+	Secret    *ObjectData         `json:"secret,omitempty"`
+}
+
+// ObjectData generates an object with the fields `key` and `value`
+// for each entry in the data of a ConfigMap or Secret, in order of
+// key. The comprehension is evaluated again when the data changes.
+type ObjectData struct {
+	// Name is the name of the ConfigMap or Secret, in the same
+	// namespace as the comprehension, and may contain interpolated
+	// expressions.
+	Name string `json:"name"`
+	// Format, if given, says how to parse each value; otherwise,
+	// values are given as strings.
+	// +kubebuilder:validation:Enum=json;yaml
+	// +optional
+	Format string `json:"format,omitempty"`
+}
+
+// SourceArtifact generates a value for each directory, or each file,
+// matching the patterns given, in the artifact of a Flux source. The
+// patterns are as for GitRepository; and as there, exactly one of
+// Directories and Files must be given. The comprehension is evaluated
+// again when the source changes, e.g., because it has a new
+// revision. The artifact is fetched subject to the controller's egress
+// policy, like the URL of a request generator.
+type SourceArtifact struct {
+	// Kind is the kind of the Flux source.
+	// +kubebuilder:validation:Enum=GitRepository;OCIRepository;Bucket
+	Kind string `json:"kind"`
+	// APIVersion is the API version of the Flux source. It defaults
+	// to `source.toolkit.fluxcd.io/v1beta2`.
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+	// Name is the name of the source, in the same namespace as the
+	// comprehension, and may contain interpolated expressions.
+	Name string `json:"name"`
+	// Directories are patterns for the directories to generate, each
+	// as an object with fields `path` and `name`.
+	// +optional
+	Directories []string `json:"directories,omitempty"`
+	// Files are patterns for the files to generate. Each value
+	// decoded from a file is generated as an object with the fields
+	// `path`, `name`, and `content`.
+	// +optional
+	Files []string `json:"files,omitempty"`
+	// Format says how to decode files, as for GitRepository.
+	// +kubebuilder:validation:Enum=json;ndjson;yaml;csv;lines
+	// +optional
+	Format string `json:"format,omitempty"`
+}
+
+// GitRepository generates a value for each directory, or each file,
+// matching the patterns given, in a git repository at a particular
+// ref. Patterns are as for path.Match, and are matched against the
+// whole path from the root of the repository; e.g., `apps/*`. Exactly
+// one of Directories and Files must be given.
+type GitRepository struct {
+	// URL is the URL of the repository, and may contain interpolated
+	// expressions. HTTPS and HTTP are supported; and file://, for
+	// local testing with the command-line tool, but not in the
+	// controller. The repository is fetched subject to the egress
+	// policy, and is limited in size as a response body is.
+	URL string `json:"url"`
+	// Ref is the branch, tag, or commit to look at, and may contain
+	// interpolated expressions. It defaults to the default branch of
+	// the repository.
+	// +optional
+	Ref string `json:"ref,omitempty"`
+	// Directories are patterns for the directories to generate. Each
+	// is generated as an object with fields `path` and `name`, the
+	// latter being the last element of the path.
+	// +optional
+	Directories []string `json:"directories,omitempty"`
+	// Files are patterns for the files to generate. Each value
+	// decoded from a file is generated as an object with the fields
+	// `path`, `name`, and `content`.
+	// +optional
+	Files []string `json:"files,omitempty"`
+	// Format says how to decode files, as for a request generator.
+	// If not given, it is guessed from the file extension; a file with
+	// an extension that isn't recognised has its content given as a
+	// string.
+	// +kubebuilder:validation:Enum=json;ndjson;yaml;csv;lines
+	// +optional
+	Format string `json:"format,omitempty"`
+	// Auth refers to a Secret with `username` and `password` fields,
+	// to use when fetching the repository. If there is no `username`,
+	// `git` is used; and `bearerToken` is accepted in place of
+	// `password`.
+	// +optional
+	Auth *RequestAuth `json:"auth,omitempty"`
+}
+
+// Range generates integers from Start, up to but not including End,
+// counting by Step. Each of these may be given as a number, or as a
+// string with interpolated expressions that evaluate to a number. A
+// range can generate at most 10000 numbers, unless the controller is
+// configured otherwise.
+type Range struct {
+	// Start is the first number generated. It defaults to 0.
+	// +optional
+	Start *intstr.IntOrString `json:"start,omitempty"`
+	// End is the number at which to stop, which is not generated.
+	End intstr.IntOrString `json:"end"`
+	// Step is the difference between successive numbers, and may be
+	// negative to count down. It defaults to 1.
+	// +optional
+	Step *intstr.IntOrString `json:"step,omitempty"`
 }
 
 type ObjectQuery struct {
@@ -61,24 +250,233 @@ type ObjectQuery struct {
 	Kind        string            `json:"kind"`
 	Name        string            `json:"name,omitempty"`
 	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+	// MatchExpressions select objects by their labels, as in a label
+	// selector. The values may contain interpolated expressions.
+	// +optional
+	MatchExpressions []metav1.LabelSelectorRequirement `json:"matchExpressions,omitempty"`
+	// FieldSelector selects objects by their fields, e.g.,
+	// `status.phase=Running`, and may contain interpolated
+	// expressions. Which fields can be used depends on the kind of
+	// object.
+	// +optional
+	FieldSelector string `json:"fieldSelector,omitempty"`
+	// Namespace is the namespace in which to look for objects, if
+	// not that of the Comprehension. It may contain interpolated
+	// expressions. Looking in other namespaces must be allowed by the
+	// controller.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// NamespaceSelector selects, by their labels, the namespaces in
+	// which to look for objects; an empty selector selects all
+	// namespaces. It cannot be given with Namespace. As with
+	// Namespace, this must be allowed by the controller.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Limit is the most objects the query will generate. If not
+	// given, all the objects selected are generated.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Limit int `json:"limit,omitempty"`
 }
 
 type HttpRequest struct {
-	URL     string   `json:"url"`
+	URL string `json:"url"`
+	// Method is the HTTP method to use. It defaults to GET, or to POST
+	// if there is a body or a GraphQL query.
+	// +optional
+	Method string `json:"method,omitempty"`
+	// Headers are given as "Name: value", and may contain
+	// interpolated expressions.
 	Headers []string `json:"headers,omitempty"`
+	// Body is sent as the body of the request, and may contain
+	// interpolated expressions in the same way as a template. A string
+	// value is sent as it is; any other value is encoded as JSON.
+	// +optional
+	Body *apiextensions.JSON `json:"body,omitempty"`
+	// GraphQL gives a query to send as the body of the request, in
+	// place of Body.
+	// +optional
+	GraphQL *GraphQLQuery `json:"graphql,omitempty"`
+	// Auth gives credentials to use with the request.
+	Auth *RequestAuth `json:"auth,omitempty"`
+	// TLS gives certificates to use when connecting to the server.
+	// +optional
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// Proxy is the URL of a proxy through which to make the
+	// request. If not given, the proxy settings in the controller's
+	// environment (e.g., HTTPS_PROXY and NO_PROXY) are used, unless
+	// the controller denies requests to some networks.
+	// +optional
+	Proxy string `json:"proxy,omitempty"`
+	// Format says how to decode the response. If not given, it is
+	// guessed from the Content-Type of the response, falling back to
+	// JSON. The formats are:
+	//  - json: a JSON value, or a stream of them
+	//  - ndjson: newline-delimited JSON values
+	//  - yaml: a YAML document, or multiple documents separated by `---`
+	//  - csv: comma-separated values with a header row; each subsequent
+	//    row is decoded as an object with the headers as field names
+	//  - lines: each non-blank line as a string
+	// +kubebuilder:validation:Enum=json;ndjson;yaml;csv;lines
+	// +optional
+	Format string `json:"format,omitempty"`
+	// Items is a CEL expression which has the decoded response as the
+	// variable `body`, and evaluates to the list of values to
+	// generate; e.g., `body.items`. If not given, each value decoded
+	// from the response is generated.
+	Items string `json:"items,omitempty"`
+	// Paginate says how to fetch further pages of results. If not
+	// given, only the first response is used.
+	Paginate *Pagination `json:"paginate,omitempty"`
+	// Timeout is how long to wait for each response, including
+	// reading the body. It defaults to 30 seconds, and can be at most
+	// 5 minutes.
+	// +kubebuilder:validation:XValidation:rule="duration(self) > duration('0s') && duration(self) <= duration('5m')",message="timeout must be positive and at most 5m"
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Retries is how many times to retry a request that fails with a
+	// server error, or with 429 Too Many Requests, backing off
+	// exponentially between tries (or waiting as long as the server
+	// asks with Retry-After). It defaults to 3 for GET, HEAD, OPTIONS,
+	// PUT and DELETE requests, and to 0 for other methods (e.g.,
+	// POST), which may not be safe to repeat.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=10
+	// +optional
+	Retries *int `json:"retries,omitempty"`
+	// MaxBodySize is the largest response body that will be read,
+	// e.g., `1Mi`; a larger response is an error. It defaults to
+	// 10Mi. The controller may impose a lower limit.
+	// +optional
+	MaxBodySize *resource.Quantity `json:"maxBodySize,omitempty"`
+	// MaxItems is the most values the request generator will
+	// generate, over all pages; more is an error. The controller may
+	// impose a lower limit.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxItems *int `json:"maxItems,omitempty"`
+}
+
+// Pagination gives a way of finding the URL for the next page of
+// results, from a response. Exactly one of Link and Next must be
+// given. The values from all pages are concatenated. Each page must be
+// at the same scheme and host as the first, since the headers and
+// credentials are sent with each request.
+type Pagination struct {
+	// Link follows the URL in a `Link` header with `rel="next"`, as
+	// given by e.g., GitHub.
+	Link bool `json:"link,omitempty"`
+	// Next is a CEL expression which has the decoded response as the
+	// variable `body`, and evaluates to the URL of the next page; or
+	// null or "" if there are no more pages.
+	Next string `json:"next,omitempty"`
+	// MaxPages limits the number of pages fetched, including the
+	// first. It defaults to 10. If there are more pages than this,
+	// it's an error, rather than the rest being left out.
+	// +optional
+	MaxPages int `json:"maxPages,omitempty"`
+}
+
+// GraphQLQuery is a convenience for constructing the body of a
+// GraphQL request.
+type GraphQLQuery struct {
+	Query string `json:"query"`
+	// Variables gives values for variables in the query. These may
+	// contain interpolated expressions.
+	// +optional
+	Variables *apiextensions.JSON `json:"variables,omitempty"`
+}
+
+// RequestAuth refers to a Secret in the same namespace as the
+// Comprehension, from which to take credentials for a request. If the
+// secret has a `bearerToken` field, it's used as a bearer token;
+// otherwise, `username` and `password` fields are used for basic
+// authentication.
+type RequestAuth struct {
+	SecretRef LocalObjectReference `json:"secretRef"`
+}
+
+// TLSConfig gives certificates to use when connecting to a server
+// with TLS, taken from a Secret or ConfigMap in the same namespace as
+// the Comprehension.
+type TLSConfig struct {
+	// SecretRef refers to a Secret with any of the fields `ca.crt`, a
+	// CA bundle for verifying the server's certificate; and `tls.crt`
+	// and `tls.key`, a client certificate and key.
+	// +optional
+	SecretRef *LocalObjectReference `json:"secretRef,omitempty"`
+	// CAConfigMapRef refers to a ConfigMap with a CA bundle in the
+	// field `ca.crt`, for verifying the server's certificate. This is
+	// an alternative to giving `ca.crt` in the secret.
+	// +optional
+	CAConfigMapRef *LocalObjectReference `json:"caConfigMapRef,omitempty"`
+	// ServerName is used to verify the server's certificate, in place
+	// of the host in the URL.
+	// +optional
+	ServerName string `json:"serverName,omitempty"`
+}
+
+// LocalObjectReference refers to an object in the same namespace as
+// the Comprehension.
+type LocalObjectReference struct {
+	Name string `json:"name"`
 }
 
 // ComprehensionSpec defines the desired state of Comprehension
 type ComprehensionSpec struct {
 	Yield TemplateExpr `json:"yield"`
 	For   []ForExpr    `json:"for"`
+	// Interval is how often to evaluate the comprehension again, to
+	// pick up changes in e.g., the responses to request generators. If
+	// not given, the comprehension is evaluated again only when it
+	// changes, or when objects it queries change.
+	// +optional
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// Jitter is the most time to add, at random, to the interval, so
+	// that comprehensions with the same interval don't all make their
+	// requests at once.
+	// +optional
+	Jitter *metav1.Duration `json:"jitter,omitempty"`
 }
 
 // ComprehensionStatus defines the observed state of Comprehension
 type ComprehensionStatus struct {
 	Inventory *Inventory `json:"inventory,omitempty"`
+	// Conditions say whether the comprehension was evaluated and its
+	// results applied (Ready), and if not, why not.
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// LastEvaluatedAt is when the comprehension was last evaluated,
+	// whether or not that succeeded.
+	// +optional
+	LastEvaluatedAt *metav1.Time `json:"lastEvaluatedAt,omitempty"`
+	// Templates gives the number of objects applied from each named
+	// template, when the comprehension yields named templates.
+	// +optional
+	Templates []TemplateStatus `json:"templates,omitempty"`
+}
+
+// TemplateStatus records the result of instantiating a named template.
+type TemplateStatus struct {
+	Name string `json:"name"`
+	// Objects is the number of objects applied from the template.
+	Objects int `json:"objects"`
 }
 
+// ReadyCondition is the type of the condition recording whether the
+// comprehension was evaluated and applied.
+const ReadyCondition = "Ready"
+
+// Reasons given in the Ready condition.
+const (
+	SucceededReason        = "Succeeded"
+	EvaluationFailedReason = "EvaluationFailed"
+	// EgressDeniedReason means a request generator tried to make a
+	// request not allowed by the controller's egress policy.
+	EgressDeniedReason = "EgressDenied"
+	RateLimitedReason  = "RateLimited"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
 
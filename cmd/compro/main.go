@@ -90,9 +90,15 @@ func (o *opts) runE(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return err
 	}
-	k8sClient = client.NewNamespacedClient(k8sClient, o.namespace)
-
-	ev := eval.Evaluator{Client: k8sClient}
+	// This runs with the user's own credentials, so there's no reason
+	// to stop queries looking in other namespaces, or git generators
+	// reading local repositories.
+	ev := eval.Evaluator{
+		Client:                 k8sClient,
+		Namespace:              o.namespace,
+		AllowCrossNamespace:    true,
+		AllowLocalRepositories: true,
+	}
 	outs, err := ev.Eval(&compro.Spec)
 	if err != nil {
 		return err
@@ -18,13 +18,20 @@ package controllers
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/rand"
 	"strings"
+	"time"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/log"
@@ -39,11 +46,32 @@ import (
 type ComprehensionReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+	// ResponseCache, if set, is shared by evaluations, so that HTTP
+	// responses can be revalidated rather than fetched anew each
+	// time.
+	ResponseCache *eval.ResponseCache
+	// Egress, if set, restricts the requests that request generators
+	// can make.
+	Egress *eval.EgressPolicy
+	// MaxBodySize and MaxItems, if positive, limit what any request
+	// generator can fetch.
+	MaxBodySize int64
+	MaxItems    int
+	// CrossNamespaceQueries are the namespaces in which comprehensions
+	// may query objects in other namespaces; "*" means any namespace.
+	CrossNamespaceQueries []string
+
+	cache   cache.Cache
+	watches *queryWatches
 }
 
 //+kubebuilder:rbac:groups=generate.squaremo.dev,resources=comprehensions,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=generate.squaremo.dev,resources=comprehensions/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=generate.squaremo.dev,resources=comprehensions/finalizers,verbs=update
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups=source.toolkit.fluxcd.io,resources=gitrepositories;ocirepositories;buckets,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -59,26 +87,83 @@ func (r *ComprehensionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 
 	var compro generate.Comprehension
 	if err := r.Get(ctx, req.NamespacedName, &compro); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.watches.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	ev := &eval.Evaluator{Client: client.NewNamespacedClient(r.Client, req.Namespace)}
+	ev := &eval.Evaluator{
+		Client:              r.Client,
+		Namespace:           req.Namespace,
+		AllowCrossNamespace: r.allowCrossNamespace(req.Namespace),
+		CacheReader:         r.cache,
+		Cache:               r.ResponseCache,
+		Egress:              r.Egress,
+		MaxBodySize:         r.MaxBodySize,
+		MaxItems:            r.MaxItems,
+	}
 
-	outs, err := ev.Eval(&compro.Spec)
+	outs, err := ev.EvalTemplates(&compro.Spec)
+	now := metav1.Now()
+	compro.Status.LastEvaluatedAt = &now
+	// Even if evaluation failed, the queries made so far may be
+	// worth watching.
+	if err := r.watches.track(req.NamespacedName, ev.Queries()); err != nil {
+		log.Error(err, "failed to watch objects queried")
+	}
 	if err != nil {
+		// Carrying on would prune everything in the inventory, so
+		// don't.
+		var rateLimited *eval.RateLimitError
+		if errors.As(err, &rateLimited) {
+			log.Info("rate limited while evaluating comprehension", "url", rateLimited.URL, "reset", rateLimited.Reset)
+			if err := r.setNotReady(ctx, &compro, generate.RateLimitedReason, err); err != nil {
+				return ctrl.Result{}, err
+			}
+			return ctrl.Result{RequeueAfter: requeueAfterReset(rateLimited.Reset)}, nil
+		}
+		var egressDenied *eval.EgressError
+		if errors.As(err, &egressDenied) {
+			// Trying again won't help until the comprehension is
+			// changed, and that will cause another reconciliation
+			// anyway.
+			log.Info("comprehension made a request not allowed by the egress policy", "host", egressDenied.Host, "reason", egressDenied.Reason)
+			return ctrl.Result{RequeueAfter: requeueAfterInterval(&compro.Spec)}, r.setNotReady(ctx, &compro, generate.EgressDeniedReason, err)
+		}
 		log.Error(err, "failed to evaluate comprehension")
+		if err := r.setNotReady(ctx, &compro, generate.EvaluationFailedReason, err); err != nil {
+			log.Error(err, "failed to record evaluation failure in status")
+		}
+		return ctrl.Result{}, err
 	}
 
 	newInventory := &generate.Inventory{}
 
+	// Count the objects from each named template, including those
+	// that yielded nothing.
+	var templates []generate.TemplateStatus
+	templateIndex := map[string]int{}
+	for i, t := range compro.Spec.Yield.Templates {
+		templates = append(templates, generate.TemplateStatus{Name: t.Name})
+		templateIndex[t.Name] = i
+	}
+	applied := func(template string) {
+		if i, ok := templateIndex[template]; ok {
+			templates[i].Objects++
+		}
+	}
+
 	for i := range outs {
-		switch out := outs[i].(type) {
+		template := outs[i].Template
+		switch out := outs[i].Value.(type) {
 		case map[string]interface{}:
 			obj, err := r.createOrUpdateObject(ctx, &compro, req.Namespace, out)
 			if err != nil {
 				return ctrl.Result{}, err // TODO do better
 			}
 			inventory.Add(newInventory, obj)
+			applied(template)
 		case []interface{}:
 			for i := range out {
 				fields, ok := out[i].(map[string]interface{})
@@ -91,9 +176,10 @@ func (r *ComprehensionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 					return ctrl.Result{}, err // TODO can do better here
 				}
 				inventory.Add(newInventory, obj)
+				applied(template)
 			}
 		default:
-			log.Info("instantiated template does not result in an object or list of objects")
+			log.Info("instantiated template does not result in an object or list of objects", "template", template)
 			continue // TODO better than this
 		}
 	}
@@ -102,8 +188,68 @@ func (r *ComprehensionReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 		log.Error(err, "pruning failed") // no reason to fail entirely
 	} // TODO: should it save the new inventory though?
 	compro.Status.Inventory = newInventory
-	err = r.Status().Update(ctx, &compro)
-	return ctrl.Result{}, err
+	compro.Status.Templates = templates
+	meta.SetStatusCondition(&compro.Status.Conditions, metav1.Condition{
+		Type:               generate.ReadyCondition,
+		Status:             metav1.ConditionTrue,
+		Reason:             generate.SucceededReason,
+		Message:            fmt.Sprintf("applied %d objects", len(newInventory.Entries)),
+		ObservedGeneration: compro.Generation,
+	})
+	if err := r.Status().Update(ctx, &compro); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: requeueAfterInterval(&compro.Spec)}, nil
+}
+
+// requeueAfterInterval gives how long to wait before evaluating the
+// comprehension again, according to its interval and jitter; zero
+// means not to requeue it.
+func requeueAfterInterval(spec *generate.ComprehensionSpec) time.Duration {
+	if spec.Interval == nil || spec.Interval.Duration <= 0 {
+		return 0
+	}
+	after := spec.Interval.Duration
+	if spec.Jitter != nil && spec.Jitter.Duration > 0 {
+		after += time.Duration(rand.Int63n(int64(spec.Jitter.Duration)))
+	}
+	return after
+}
+
+// setNotReady records in the status of the comprehension that it
+// could not be evaluated, and why.
+func (r *ComprehensionReconciler) setNotReady(ctx context.Context, compro *generate.Comprehension, reason string, err error) error {
+	meta.SetStatusCondition(&compro.Status.Conditions, metav1.Condition{
+		Type:               generate.ReadyCondition,
+		Status:             metav1.ConditionFalse,
+		Reason:             reason,
+		Message:            err.Error(),
+		ObservedGeneration: compro.Generation,
+	})
+	return r.Status().Update(ctx, compro)
+}
+
+// allowCrossNamespace says whether comprehensions in the namespace
+// given may query objects in other namespaces.
+func (r *ComprehensionReconciler) allowCrossNamespace(namespace string) bool {
+	for _, ns := range r.CrossNamespaceQueries {
+		if ns == "*" || ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// minRequeueAfter is the least time to wait before trying again
+// after being rate limited; the reset time may be in the past, or
+// very close, by the time it's considered.
+const minRequeueAfter = time.Second
+
+func requeueAfterReset(reset time.Time) time.Duration {
+	if after := time.Until(reset); after > minRequeueAfter {
+		return after
+	}
+	return minRequeueAfter
 }
 
 func (r *ComprehensionReconciler) createOrUpdateObject(ctx context.Context, owner client.Object, namespace string, fields map[string]interface{}) (*unstructured.Unstructured, error) {
@@ -188,9 +334,15 @@ func objectFromObjectRef(ref generate.ObjectRef) (client.Object, error) {
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *ComprehensionReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	c, err := ctrl.NewControllerManagedBy(mgr).
 		For(&generate.Comprehension{},
 			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
 		).
-		Complete(r)
+		Build(r)
+	if err != nil {
+		return err
+	}
+	r.cache = mgr.GetCache()
+	r.watches = newQueryWatches(c, mgr.GetCache())
+	return nil
 }
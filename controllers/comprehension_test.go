@@ -19,6 +19,9 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -421,4 +424,203 @@ spec:
 		})
 	})
 
+	When("there's a request generator that's not allowed by the egress policy", func() {
+		const compro = `
+apiVersion: generate.squaremo.dev/v1alpha1
+kind: Comprehension
+spec:
+  yield:
+    template:
+      apiVersion: v1
+      kind: ConfigMap
+      metadata:
+        name: metadata
+      data: ${md}
+  for:
+  - var: md
+    in:
+      request:
+        url: http://169.254.169.254/latest/meta-data/
+`
+		var namespace string
+		BeforeEach(func() {
+			namespace = newNamespace()
+			createComprehension(namespace, compro)
+		})
+
+		It("reports the request was denied in the status", func() {
+			var obj generate.Comprehension
+			Eventually(func() []metav1.Condition {
+				Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+					Namespace: namespace,
+					Name:      "testcase",
+				}, &obj)).To(Succeed())
+				return obj.Status.Conditions
+			}, "3s", "0.5s").Should(ContainElement(SatisfyAll(
+				HaveField("Type", generate.ReadyCondition),
+				HaveField("Status", metav1.ConditionFalse),
+				HaveField("Reason", generate.EgressDeniedReason),
+			)))
+		})
+	})
+
+	When("there's a query generator and the objects it selects change", func() {
+		const compro = `
+apiVersion: generate.squaremo.dev/v1alpha1
+kind: Comprehension
+spec:
+  yield:
+    template:
+      apiVersion: v1
+      kind: Secret
+      metadata:
+        name: secret-${cm.metadata.name}
+  for:
+  - var: cm
+    in:
+      query:
+        apiVersion: v1
+        kind: ConfigMap
+        matchLabels:
+          app: watched
+`
+		var namespace string
+		var secrets corev1.SecretList
+		countSecrets := func() int {
+			Expect(k8sClient.List(context.TODO(), &secrets, &client.ListOptions{
+				Namespace: namespace,
+			})).To(Succeed())
+			return len(secrets.Items)
+		}
+		createWatchedConfigMap := func(name string) {
+			cm := &corev1.ConfigMap{}
+			cm.Name = name
+			cm.Labels = map[string]string{"app": "watched"}
+			createObjectsInNamespace(namespace, cm)
+		}
+
+		BeforeEach(func() {
+			namespace = newNamespace()
+			createWatchedConfigMap("watched-0")
+			createComprehension(namespace, compro)
+			Eventually(countSecrets, "3s", "0.5s").Should(Equal(1))
+		})
+
+		It("reevaluates the comprehension", func() {
+			createWatchedConfigMap("watched-1")
+			Eventually(countSecrets, "3s", "0.5s").Should(Equal(2))
+		})
+	})
+
+	When("there's a comprehension with an interval", func() {
+		var server *httptest.Server
+		var requests int32
+		var namespace string
+
+		BeforeEach(func() {
+			atomic.StoreInt32(&requests, 0)
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				w.Write([]byte(`["foo"]`))
+			}))
+			namespace = newNamespace()
+			createComprehension(namespace, `
+apiVersion: generate.squaremo.dev/v1alpha1
+kind: Comprehension
+spec:
+  interval: 1s
+  yield:
+    template:
+      apiVersion: v1
+      kind: ConfigMap
+      metadata:
+        name: interval-${v}
+  for:
+  - var: v
+    in:
+      request:
+        url: `+server.URL+`
+`)
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("evaluates the comprehension repeatedly", func() {
+			Eventually(func() int32 {
+				return atomic.LoadInt32(&requests)
+			}, "5s", "0.5s").Should(BeNumerically(">=", 3))
+		})
+
+		It("records when it was last evaluated", func() {
+			var obj generate.Comprehension
+			Eventually(func() *metav1.Time {
+				Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+					Namespace: namespace,
+					Name:      "testcase",
+				}, &obj)).To(Succeed())
+				return obj.Status.LastEvaluatedAt
+			}, "3s", "0.5s").ShouldNot(BeNil())
+		})
+	})
+
+	When("there's a comprehension with named templates", func() {
+		var namespace string
+
+		BeforeEach(func() {
+			namespace = newNamespace()
+			createComprehension(namespace, `
+apiVersion: generate.squaremo.dev/v1alpha1
+kind: Comprehension
+spec:
+  yield:
+    templates:
+    - name: config
+      template:
+        apiVersion: v1
+        kind: ConfigMap
+        metadata:
+          name: config-${app}
+    - name: secret
+      when: app == "db"
+      template:
+        apiVersion: v1
+        kind: Secret
+        metadata:
+          name: secret-${app}
+  for:
+  - var: app
+    in:
+      list: [web, db]
+`)
+		})
+
+		It("creates the objects from each template", func() {
+			Eventually(func() error {
+				return k8sClient.Get(context.TODO(), types.NamespacedName{
+					Namespace: namespace,
+					Name:      "secret-db",
+				}, &corev1.Secret{})
+			}, "5s", "0.5s").Should(Succeed())
+			Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+				Namespace: namespace,
+				Name:      "secret-web",
+			}, &corev1.Secret{})).NotTo(Succeed())
+		})
+
+		It("records the objects from each template in the status", func() {
+			var obj generate.Comprehension
+			Eventually(func() []generate.TemplateStatus {
+				Expect(k8sClient.Get(context.TODO(), types.NamespacedName{
+					Namespace: namespace,
+					Name:      "testcase",
+				}, &obj)).To(Succeed())
+				return obj.Status.Templates
+			}, "5s", "0.5s").Should(Equal([]generate.TemplateStatus{
+				{Name: "config", Objects: 2},
+				{Name: "secret", Objects: 1},
+			}))
+		})
+	})
 })
@@ -24,6 +24,7 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -33,6 +34,7 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	generatev1alpha1 "github.com/squaremo/comprehension-controller/api/v1alpha1"
+	"github.com/squaremo/comprehension-controller/internal/eval"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -78,13 +80,18 @@ var _ = BeforeSuite(func() {
 	ctx, cancel = context.WithCancel(context.TODO())
 
 	k8sManager, err := ctrl.NewManager(cfg, ctrl.Options{
-		Scheme: scheme.Scheme,
+		Scheme:                scheme.Scheme,
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}},
 	})
 	Expect(err).ToNot(HaveOccurred())
 
+	egress, err := eval.NewEgressPolicy(nil, []string{"169.254.0.0/16"})
+	Expect(err).ToNot(HaveOccurred())
+
 	err = (&ComprehensionReconciler{
 		Client: k8sManager.GetClient(),
 		Scheme: k8sManager.GetScheme(),
+		Egress: egress,
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 
@@ -0,0 +1,119 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/squaremo/comprehension-controller/internal/eval"
+)
+
+var secretGVK = corev1.SchemeGroupVersion.WithKind("Secret")
+
+// queryWatches keeps track of the queries made by each comprehension,
+// and watches the kinds of object queried, so that a comprehension
+// can be reevaluated when objects it would see change.
+type queryWatches struct {
+	controller controller.Controller
+	cache      cache.Cache
+
+	mu      sync.Mutex
+	watched map[schema.GroupVersionKind]struct{}
+	queries map[types.NamespacedName][]eval.Query
+}
+
+func newQueryWatches(c controller.Controller, cache cache.Cache) *queryWatches {
+	return &queryWatches{
+		controller: c,
+		cache:      cache,
+		watched:    map[schema.GroupVersionKind]struct{}{},
+		queries:    map[types.NamespacedName][]eval.Query{},
+	}
+}
+
+// track records the queries made by the comprehension given, in place
+// of any recorded before, and starts watching any kinds of object not
+// already watched.
+func (w *queryWatches) track(name types.NamespacedName, queries []eval.Query) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.queries[name] = queries
+	for i := range queries {
+		gvk := queries[i].GVK
+		if _, ok := w.watched[gvk]; ok {
+			continue
+		}
+		// Only the metadata of an object is needed to tell which
+		// queries it matches. For Secrets, which are read as needed
+		// rather than cached, watching only the metadata means their
+		// contents aren't kept in memory.
+		var obj client.Object
+		if gvk == secretGVK {
+			meta := &metav1.PartialObjectMetadata{}
+			meta.SetGroupVersionKind(gvk)
+			obj = meta
+		} else {
+			u := &unstructured.Unstructured{}
+			u.SetGroupVersionKind(gvk)
+			obj = u
+		}
+		if err := w.controller.Watch(source.NewKindWithCache(obj, w.cache),
+			handler.EnqueueRequestsFromMapFunc(w.comprehensionsFor)); err != nil {
+			return err
+		}
+		w.watched[gvk] = struct{}{}
+	}
+	return nil
+}
+
+// forget stops tracking the queries of a comprehension. The kinds
+// it queried are still watched, since watches can't be removed; but
+// changes to them won't cause it to be reevaluated.
+func (w *queryWatches) forget(name types.NamespacedName) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.queries, name)
+}
+
+// comprehensionsFor gives a request for each comprehension with a
+// query that the object matches.
+func (w *queryWatches) comprehensionsFor(obj client.Object) []reconcile.Request {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var requests []reconcile.Request
+	for name, queries := range w.queries {
+		for i := range queries {
+			if queries[i].Matches(obj) {
+				requests = append(requests, reconcile.Request{NamespacedName: name})
+				break
+			}
+		}
+	}
+	return requests
+}
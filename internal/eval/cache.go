@@ -0,0 +1,137 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// response is what's kept of an HTTP response: enough to decode the
+// body, and to find the next page of results.
+type response struct {
+	url    *url.URL
+	header http.Header
+	body   []byte
+}
+
+// requestKey gives a key identifying the request, for memoising and
+// caching responses. It's a hash, so that credentials in headers
+// aren't kept around as they are. The transport identity is part of
+// the key, since the same request made with a different client
+// certificate or through a different proxy may get a different
+// response; and the cache is shared by all comprehensions.
+func requestKey(req *http.Request, body *requestBody, transport string) string {
+	h := sha256.New()
+	h.Write([]byte(transport))
+	h.Write([]byte{0})
+	h.Write([]byte(req.Method))
+	h.Write([]byte{0})
+	h.Write([]byte(req.URL.String()))
+	h.Write([]byte{0})
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			h.Write([]byte(name))
+			h.Write([]byte{':'})
+			h.Write([]byte(value))
+			h.Write([]byte{0})
+		}
+	}
+	if body != nil {
+		h.Write(body.data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ResponseCache keeps responses that came with a validator (an ETag
+// or Last-Modified header), so that they can be revalidated with a
+// conditional request in later evaluations, rather than fetched
+// again. When it's full, the least recently used response is
+// dropped. It is safe to use from more than one goroutine.
+type ResponseCache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used at the front
+}
+
+type cacheEntry struct {
+	key  string
+	resp *response
+}
+
+// NewResponseCache creates a ResponseCache which will hold up to
+// `size` responses.
+func NewResponseCache(size int) *ResponseCache {
+	return &ResponseCache{
+		size:    size,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+	}
+}
+
+func (c *ResponseCache) get(key string) *response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cacheEntry).resp
+	}
+	return nil
+}
+
+// put records the response against the key, if it has a validator.
+func (c *ResponseCache) put(key string, resp *response) {
+	if resp.header.Get("ETag") == "" && resp.header.Get("Last-Modified") == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*cacheEntry).resp = resp
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, resp: resp})
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// setConditional adds headers to the request so that it's
+// conditional on the cached response being out of date.
+func setConditional(req *http.Request, cached *response) {
+	if etag := cached.header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := cached.header.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+func Test_ResponseCache(t *testing.T) {
+	withETag := func(etag string) *response {
+		return &response{header: http.Header{"Etag": []string{etag}}}
+	}
+
+	t.Run("ignores responses without a validator", func(t *testing.T) {
+		g := NewWithT(t)
+		cache := NewResponseCache(2)
+		cache.put("a", &response{header: http.Header{}})
+		g.Expect(cache.get("a")).To(BeNil())
+	})
+
+	t.Run("drops the least recently used response", func(t *testing.T) {
+		g := NewWithT(t)
+		cache := NewResponseCache(2)
+		a, b, c := withETag("a"), withETag("b"), withETag("c")
+		cache.put("a", a)
+		cache.put("b", b)
+		g.Expect(cache.get("a")).To(Equal(a)) // now b is least recently used
+		cache.put("c", c)
+		g.Expect(cache.get("b")).To(BeNil())
+		g.Expect(cache.get("a")).To(Equal(a))
+		g.Expect(cache.get("c")).To(Equal(c))
+	})
+
+	t.Run("keys requests by transport", func(t *testing.T) {
+		g := NewWithT(t)
+		req, err := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+		g.Expect(err).NotTo(HaveOccurred())
+
+		plain := &generate.HttpRequest{URL: req.URL.String()}
+		withTLS := &generate.HttpRequest{URL: req.URL.String(), TLS: &generate.TLSConfig{
+			SecretRef: &generate.LocalObjectReference{Name: "client-cert"},
+		}}
+		withProxy := &generate.HttpRequest{URL: req.URL.String(), Proxy: "http://proxy.example.com"}
+		withAuth := &generate.HttpRequest{URL: req.URL.String(), Auth: &generate.RequestAuth{
+			SecretRef: generate.LocalObjectReference{Name: "token"},
+		}}
+
+		keys := map[string]bool{}
+		for _, ev := range []*Evaluator{{Namespace: "a"}, {Namespace: "b"}} {
+			for _, request := range []*generate.HttpRequest{withTLS, withProxy, withAuth} {
+				keys[requestKey(req, nil, ev.transportIdentity(request))] = true
+			}
+			keys[requestKey(req, nil, ev.transportIdentity(plain))] = true
+		}
+		// the plain request is the same in each namespace
+		g.Expect(keys).To(HaveLen(7))
+	})
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"bytes"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+// == configMap, secret
+
+// objectDataFunc fetches the data of a ConfigMap or Secret. It also
+// says whether the data is secret, in which case it must not appear
+// in errors (which end up in logs and in the status).
+type objectDataFunc func(ev *Evaluator, name string) (data map[string][]byte, secret bool, err error)
+
+func configMapData(ev *Evaluator, name string) (map[string][]byte, bool, error) {
+	var cm corev1.ConfigMap
+	if err := ev.getQueried(corev1.SchemeGroupVersion.WithKind("ConfigMap"), name, &cm); err != nil {
+		return nil, false, fmt.Errorf("cannot get ConfigMap %s: %w", name, err)
+	}
+	data := make(map[string][]byte, len(cm.Data)+len(cm.BinaryData))
+	for k, v := range cm.Data {
+		data[k] = []byte(v)
+	}
+	for k, v := range cm.BinaryData {
+		data[k] = v
+	}
+	return data, false, nil
+}
+
+func secretData(ev *Evaluator, name string) (map[string][]byte, bool, error) {
+	var secret corev1.Secret
+	if err := ev.getQueried(corev1.SchemeGroupVersion.WithKind("Secret"), name, &secret); err != nil {
+		return nil, true, fmt.Errorf("cannot get Secret %s: %w", name, err)
+	}
+	return secret.Data, true, nil
+}
+
+func compileObjectData(e *env, spec *generate.ObjectData, fetch objectDataFunc) (eagerGeneratorFunc, error) {
+	spec = spec.DeepCopy()
+	ce, err := e.celEnv()
+	if err != nil {
+		return nil, err
+	}
+	nameEval, err := compileString(ce, spec.Name, replaceStrPointer(&spec.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error) {
+		if nameEval != nil {
+			if err := nameEval(ar); err != nil {
+				return nil, err
+			}
+		}
+		data, secret, err := fetch(ev, spec.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		var result []interface{}
+		for _, key := range sortedKeys(data) {
+			var value interface{} = string(data[key])
+			if spec.Format != "" {
+				if value, err = parseDataValue(spec.Format, data[key]); err != nil {
+					if secret {
+						// The error from decoding may quote the value.
+						return nil, fmt.Errorf("cannot parse value of %q in Secret %s as %s", key, spec.Name, spec.Format)
+					}
+					return nil, fmt.Errorf("cannot parse value of %q in ConfigMap %s as %s: %w", key, spec.Name, spec.Format, err)
+				}
+			}
+			result = append(result, map[string]interface{}{
+				"key":   key,
+				"value": value,
+			})
+		}
+		return result, nil
+	}, nil
+}
+
+// parseDataValue parses a single value, expecting exactly one
+// document.
+func parseDataValue(format string, data []byte) (interface{}, error) {
+	values, err := decodeResponse(format, bytes.NewReader(data), 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 1 {
+		return nil, fmt.Errorf("expected one value, got %d", len(values))
+	}
+	return values[0], nil
+}
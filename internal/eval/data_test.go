@@ -0,0 +1,155 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// unsyncedReader is like a cache for a kind the controller can't
+// watch: reads wait for it to sync, until they're given up on.
+type unsyncedReader struct{}
+
+func (unsyncedReader) Get(ctx context.Context, _ client.ObjectKey, obj client.Object, _ ...client.GetOption) error {
+	<-ctx.Done()
+	return apierrors.NewTimeoutError("failed waiting for Informer to sync", 0)
+}
+
+func (unsyncedReader) List(ctx context.Context, _ client.ObjectList, _ ...client.ListOption) error {
+	<-ctx.Done()
+	return apierrors.NewTimeoutError("failed waiting for Informer to sync", 0)
+}
+
+func Test_objectData(t *testing.T) {
+	k8sClient := fake.NewClientBuilder().WithObjects(
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tenants"},
+			Data: map[string]string{
+				"team-b": "{quota: 20}",
+				"team-a": "{quota: 10}",
+			},
+			BinaryData: map[string][]byte{
+				"team-c": []byte("{quota: 30}"),
+			},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "tokens"},
+			Data: map[string][]byte{
+				"team-a": []byte("hunter2"),
+			},
+		},
+	).Build()
+	newEval := func() *Evaluator {
+		return &Evaluator{Client: k8sClient, Namespace: "default"}
+	}
+
+	t.Run("configMap yields entries as strings", func(t *testing.T) {
+		g := NewWithT(t)
+		ev := newEval()
+		expectGeneratorItems(g, `
+configMap:
+  name: tenants
+`, ev, Equal([]interface{}{
+			map[string]interface{}{"key": "team-a", "value": "{quota: 10}"},
+			map[string]interface{}{"key": "team-b", "value": "{quota: 20}"},
+			map[string]interface{}{"key": "team-c", "value": "{quota: 30}"},
+		}))
+		g.Expect(ev.Queries()).To(ConsistOf(Query{
+			GVK:       corev1.SchemeGroupVersion.WithKind("ConfigMap"),
+			Namespace: "default",
+			Name:      "tenants",
+		}))
+	})
+
+	t.Run("configMap parses values", func(t *testing.T) {
+		g := NewWithT(t)
+		expectGeneratorItems(g, `
+configMap:
+  name: tenants
+  format: yaml
+`, newEval(), ConsistOf(
+			map[string]interface{}{"key": "team-a", "value": map[string]interface{}{"quota": float64(10)}},
+			map[string]interface{}{"key": "team-b", "value": map[string]interface{}{"quota": float64(20)}},
+			map[string]interface{}{"key": "team-c", "value": map[string]interface{}{"quota": float64(30)}},
+		))
+	})
+
+	t.Run("secret yields entries", func(t *testing.T) {
+		g := NewWithT(t)
+		expectGeneratorItems(g, `
+secret:
+  name: tokens
+`, newEval(), Equal([]interface{}{
+			map[string]interface{}{"key": "team-a", "value": "hunter2"},
+		}))
+	})
+
+	t.Run("secret is read with the client rather than the cache", func(t *testing.T) {
+		g := NewWithT(t)
+		ev := newEval()
+		// This would fail, were it used.
+		ev.CacheReader = unsyncedReader{}
+		expectGeneratorItems(g, `
+secret:
+  name: tokens
+`, ev, HaveLen(1))
+	})
+
+	t.Run("secret values are kept out of errors", func(t *testing.T) {
+		g := NewWithT(t)
+		err := expectGeneratorError(g, `
+secret:
+  name: tokens
+  format: json
+`, newEval())
+		g.Expect(err.Error()).To(ContainSubstring("team-a"))
+		g.Expect(err.Error()).NotTo(ContainSubstring("hunter2"))
+	})
+
+	t.Run("missing object fails, and is recorded", func(t *testing.T) {
+		g := NewWithT(t)
+		ev := newEval()
+		expectGeneratorError(g, `
+configMap:
+  name: nonesuch
+`, ev)
+		g.Expect(ev.Queries()).To(HaveLen(1))
+	})
+
+	t.Run("gives up when the cache doesn't sync", func(t *testing.T) {
+		defer func(d time.Duration) { readTimeout = d }(readTimeout)
+		readTimeout = 10 * time.Millisecond
+
+		g := NewWithT(t)
+		ev := newEval()
+		ev.CacheReader = unsyncedReader{}
+		err := expectGeneratorError(g, `
+configMap:
+  name: tenants
+`, ev)
+		g.Expect(err.Error()).To(ContainSubstring("timed out"))
+	})
+}
@@ -0,0 +1,192 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// Formats in which a response can be decoded. These correspond to
+// the values allowed for `.format` in a request generator.
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatYAML   = "yaml"
+	formatCSV    = "csv"
+	formatLines  = "lines"
+)
+
+// formatFromContentType guesses the format of a response from its
+// Content-Type header. When in doubt, it says JSON. In particular,
+// text/plain is taken to be JSON, since plenty of servers (including
+// raw.githubusercontent.com) serve JSON files that way.
+func formatFromContentType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return formatJSON
+	}
+	switch mediaType {
+	case "application/x-ndjson", "application/jsonl", "application/jsonlines":
+		return formatNDJSON
+	case "application/yaml", "application/x-yaml", "text/yaml", "text/x-yaml":
+		return formatYAML
+	case "text/csv":
+		return formatCSV
+	default:
+		return formatJSON
+	}
+}
+
+// errTooManyValues is returned when decoding is abandoned because
+// there are more values than wanted.
+var errTooManyValues = errors.New("too many values")
+
+// decodeResponse decodes the values in a response body, according to
+// the format given. If maxValues is positive, and there are more
+// values than that, it stops decoding and returns errTooManyValues.
+func decodeResponse(format string, r io.Reader, maxValues int) ([]interface{}, error) {
+	switch format {
+	case formatJSON, formatNDJSON:
+		return decodeJSON(r, maxValues)
+	case formatYAML:
+		return decodeYAML(r, maxValues)
+	case formatCSV:
+		return decodeCSV(r, maxValues)
+	case formatLines:
+		return decodeLines(r, maxValues)
+	default:
+		return nil, fmt.Errorf("unknown response format %q", format)
+	}
+}
+
+// decodeJSON decodes a stream of JSON values. This covers both a
+// single JSON value and newline-delimited JSON.
+func decodeJSON(r io.Reader, maxValues int) ([]interface{}, error) {
+	var result []interface{}
+	jd := json.NewDecoder(r)
+	for {
+		var val interface{}
+		if err := jd.Decode(&val); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot decode JSON: %w", err)
+		}
+		if tooMany(result, maxValues) {
+			return nil, errTooManyValues
+		}
+		result = append(result, val)
+	}
+	return result, nil
+}
+
+// decodeYAML decodes each document in a (possibly) multi-document
+// YAML stream. Empty documents are skipped. The values are converted
+// via JSON, so they are the same as you would get from decodeJSON.
+func decodeYAML(r io.Reader, maxValues int) ([]interface{}, error) {
+	var result []interface{}
+	yr := utilyaml.NewYAMLReader(bufio.NewReader(r))
+	for {
+		doc, err := yr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read YAML: %w", err)
+		}
+		if len(bytes.TrimSpace(doc)) == 0 {
+			continue
+		}
+		var val interface{}
+		if err := yaml.Unmarshal(doc, &val); err != nil {
+			return nil, fmt.Errorf("cannot decode YAML: %w", err)
+		}
+		if val == nil {
+			continue // e.g., a document with only comments
+		}
+		if tooMany(result, maxValues) {
+			return nil, errTooManyValues
+		}
+		result = append(result, val)
+	}
+	return result, nil
+}
+
+// decodeCSV decodes CSV with a header row, into an object per
+// subsequent row, with the column headers as field names.
+func decodeCSV(r io.Reader, maxValues int) ([]interface{}, error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot read CSV header: %w", err)
+	}
+
+	var result []interface{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read CSV: %w", err)
+		}
+		row := map[string]interface{}{}
+		for i := range header {
+			row[header[i]] = record[i]
+		}
+		if tooMany(result, maxValues) {
+			return nil, errTooManyValues
+		}
+		result = append(result, row)
+	}
+	return result, nil
+}
+
+// decodeLines gives each non-blank line as a string.
+func decodeLines(r io.Reader, maxValues int) ([]interface{}, error) {
+	var result []interface{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if tooMany(result, maxValues) {
+			return nil, errTooManyValues
+		}
+		result = append(result, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read lines: %w", err)
+	}
+	return result, nil
+}
+
+// tooMany says whether adding another value would exceed maxValues.
+func tooMany(values []interface{}, maxValues int) bool {
+	return maxValues > 0 && len(values) >= maxValues
+}
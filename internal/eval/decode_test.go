@@ -0,0 +1,102 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"fmt"
+	"strings"
+)
+
+func printDecoded(format, s string) {
+	values, err := decodeResponse(format, strings.NewReader(s), 0)
+	if err != nil {
+		panic(err)
+	}
+	for i := range values {
+		printAsJSON(values[i])
+	}
+}
+
+func Example_decode_json() {
+	printDecoded(formatJSON, `[{"a": 1}, {"b": 2}]`)
+	// Output:
+	// [{"a":1},{"b":2}]
+}
+
+func Example_decode_ndjson() {
+	printDecoded(formatNDJSON, `{"a": 1}
+{"b": 2}
+`)
+	// Output:
+	// {"a":1}
+	// {"b":2}
+}
+
+func Example_decode_yaml() {
+	printDecoded(formatYAML, `---
+apiVersion: v1
+entries:
+  podinfo:
+  - version: 6.3.0
+---
+# just a comment
+---
+- foo
+- bar
+`)
+	// Output:
+	// {"apiVersion":"v1","entries":{"podinfo":[{"version":"6.3.0"}]}}
+	// ["foo","bar"]
+}
+
+func Example_decode_csv() {
+	printDecoded(formatCSV, `name,port
+web,80
+"api, v2",8080
+`)
+	// Output:
+	// {"name":"web","port":"80"}
+	// {"name":"api, v2","port":"8080"}
+}
+
+func Example_decode_lines() {
+	printDecoded(formatLines, "foo\r\n\nbar\n  \nbaz")
+	// Output:
+	// "foo"
+	// "bar"
+	// "baz"
+}
+
+func Example_formatFromContentType() {
+	for _, ct := range []string{
+		"application/json; charset=utf-8",
+		"application/x-ndjson",
+		"application/x-yaml",
+		"text/csv",
+		"text/plain; charset=utf-8",
+		"bogus",
+	} {
+		fmt.Println(formatFromContentType(ct))
+	}
+	// Output:
+	// json
+	// ndjson
+	// yaml
+	// csv
+	// json
+	// json
+}
@@ -0,0 +1,212 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxRedirects is how many redirects are followed, as with the
+// default HTTP client.
+const maxRedirects = 10
+
+// EgressPolicy restricts where request generators can send requests,
+// so that whoever can create a Comprehension cannot use the
+// controller to reach e.g., cloud metadata endpoints or services
+// inside the cluster. The policy is checked against each URL after
+// interpolation, against each redirect, and against each address
+// connected to (which catches host names that resolve to denied
+// addresses). Since a proxy would connect on the controller's behalf,
+// with no such check, the proxy settings in the environment are
+// ignored when there are denied networks; and a proxy given by a
+// request generator is only used after checking every address the
+// host name resolves to.
+type EgressPolicy struct {
+	// AllowedHosts are patterns, as for path.Match (e.g.,
+	// `*.example.com`), for the hosts that can be requested. If empty,
+	// any host can be requested, subject to DeniedNetworks.
+	AllowedHosts []string
+	// DeniedNetworks are ranges of IP addresses that cannot be
+	// connected to, whatever the host name.
+	DeniedNetworks []*net.IPNet
+
+	// lookupIP resolves host names for checkHost; it's
+	// net.DefaultResolver.LookupIP if nil.
+	lookupIP func(ctx context.Context, network, host string) ([]net.IP, error)
+
+	once   sync.Once
+	client *http.Client
+}
+
+// NewEgressPolicy constructs an EgressPolicy from host patterns and
+// CIDRs (e.g., `169.254.0.0/16`).
+func NewEgressPolicy(allowedHosts, deniedCIDRs []string) (*EgressPolicy, error) {
+	policy := &EgressPolicy{}
+	for _, pattern := range allowedHosts {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+		policy.AllowedHosts = append(policy.AllowedHosts, pattern)
+	}
+	for _, cidr := range deniedCIDRs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		policy.DeniedNetworks = append(policy.DeniedNetworks, network)
+	}
+	return policy, nil
+}
+
+// EgressError is returned when a request is not allowed by the
+// egress policy.
+type EgressError struct {
+	Host   string
+	Reason string
+}
+
+func (e *EgressError) Error() string {
+	return fmt.Sprintf("request to %s not allowed by egress policy: %s", e.Host, e.Reason)
+}
+
+// checkURL returns an EgressError if the URL is not allowed by the
+// policy. A nil policy allows everything.
+func (p *EgressPolicy) checkURL(u *url.URL) error {
+	if p == nil {
+		return nil
+	}
+	host := strings.ToLower(u.Hostname())
+	if len(p.AllowedHosts) > 0 {
+		allowed := false
+		for _, pattern := range p.AllowedHosts {
+			if ok, _ := path.Match(pattern, host); ok {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &EgressError{Host: host, Reason: "host is not in the allowed hosts"}
+		}
+	}
+	// An address given literally can be refused now, rather than on
+	// connecting, which gives a clearer error.
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(host, ip)
+	}
+	return nil
+}
+
+func (p *EgressPolicy) checkIP(host string, ip net.IP) error {
+	for _, network := range p.DeniedNetworks {
+		if network.Contains(ip) {
+			return &EgressError{Host: host, Reason: fmt.Sprintf("address %s is in denied network %s", ip, network)}
+		}
+	}
+	return nil
+}
+
+// checkHost resolves the host name given, and returns an EgressError
+// if any of its addresses are in the denied networks. This is for
+// when the address connected to isn't the host's; i.e., through a
+// proxy.
+func (p *EgressPolicy) checkHost(ctx context.Context, host string) error {
+	if p == nil || len(p.DeniedNetworks) == 0 {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return p.checkIP(host, ip)
+	}
+	lookupIP := p.lookupIP
+	if lookupIP == nil {
+		lookupIP = net.DefaultResolver.LookupIP
+	}
+	ips, err := lookupIP(ctx, "ip", host)
+	if err != nil {
+		return &EgressError{Host: host, Reason: fmt.Sprintf("cannot resolve host: %v", err)}
+	}
+	for _, ip := range ips {
+		if err := p.checkIP(host, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// control is used as the Control func of a net.Dialer, so that the
+// address is checked after the host name has been resolved.
+func (p *EgressPolicy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("cannot parse address %q", host)
+	}
+	return p.checkIP(host, ip)
+}
+
+// transport gives a new transport that refuses to connect to the
+// denied networks. It doesn't use the proxy settings from the
+// environment if there are denied networks, since the proxy would be
+// what's connected to.
+func (p *EgressPolicy) transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if len(p.DeniedNetworks) > 0 {
+		transport.Proxy = nil
+	}
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   p.control,
+	}
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// checkRedirect is used as the CheckRedirect func of an HTTP client,
+// so that redirects are subject to the policy.
+func (p *EgressPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("stopped after too many redirects")
+	}
+	return p.checkURL(req.URL)
+}
+
+// sharedClient gives a client that follows the policy, for request
+// generators that don't need a transport of their own. It's shared
+// so that connections can be reused.
+func (p *EgressPolicy) sharedClient() *http.Client {
+	p.once.Do(func() {
+		p.client = &http.Client{
+			Transport:     p.transport(),
+			CheckRedirect: p.checkRedirect,
+		}
+	})
+	return p.client
+}
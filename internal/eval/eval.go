@@ -19,8 +19,11 @@ package eval
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/google/cel-go/cel"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
@@ -29,6 +32,47 @@ import (
 // Evaluator is for running comprehensions.
 type Evaluator struct {
 	client.Client
+	// Namespace is the namespace of the comprehension. Queries look
+	// for objects in this namespace unless they say otherwise, and
+	// secrets and config maps are fetched from it.
+	Namespace string
+	// AllowCrossNamespace permits queries to look for objects in
+	// namespaces other than Namespace.
+	AllowCrossNamespace bool
+	// CacheReader, if set, is used in place of the client for
+	// queries, e.g., to read from the informer cache of a controller.
+	// Secrets are always read with the client, which should not
+	// cache them.
+	CacheReader client.Reader
+	// Cache, if set, keeps HTTP responses between evaluations, so
+	// that they can be revalidated rather than fetched again.
+	Cache *ResponseCache
+	// Egress, if set, restricts the requests made by request
+	// generators.
+	Egress *EgressPolicy
+	// AllowLocalRepositories permits git generators to use file://
+	// URLs, which read from the local filesystem. It's for running
+	// comprehensions on your own machine; a controller should not
+	// allow it.
+	AllowLocalRepositories bool
+	// MaxBodySize, if positive, is the largest response body any
+	// request generator can read, whatever it asks for.
+	MaxBodySize int64
+	// MaxItems, if positive, is the most values any request generator
+	// can generate, whatever it asks for, and the most values any
+	// range generator can generate (otherwise 10000).
+	MaxItems int
+
+	// responses memoises HTTP responses within an evaluation.
+	responses map[string]*response
+	// queries records the queries made in an evaluation.
+	queries []Query
+	// trees memoises the trees fetched from git repositories within
+	// an evaluation.
+	trees map[string]*object.Tree
+	// artifacts memoises the Flux source artifacts fetched within an
+	// evaluation.
+	artifacts map[string]*artifact
 }
 
 type env struct {
@@ -38,21 +82,145 @@ type env struct {
 
 type generated struct {
 	name   string
+	vars   []string
 	values generatorFunc
 	when   cel.Program
 }
 
+// bind assigns a value from the generator to the variable of the for
+// clause, or destructures it into the variables.
+func (g *generated) bind(ar map[string]interface{}, val interface{}) error {
+	if g.vars == nil {
+		ar[g.name] = val
+		return nil
+	}
+	switch v := val.(type) {
+	case []interface{}:
+		if len(v) != len(g.vars) {
+			return fmt.Errorf("cannot destructure a list of %d items into %d variables", len(v), len(g.vars))
+		}
+		for i, name := range g.vars {
+			ar[name] = v[i]
+		}
+	case map[string]interface{}:
+		for _, name := range g.vars {
+			field, ok := v[name]
+			if !ok {
+				return fmt.Errorf("cannot destructure an object without the field %q", name)
+			}
+			ar[name] = field
+		}
+	default:
+		return fmt.Errorf("cannot destructure a value of type %T; expected a list or an object", val)
+	}
+	return nil
+}
+
+// forVars checks the variables of a for clause, against themselves
+// and those bound by previous for clauses, and returns the names of
+// the variables to destructure into, if there's more than one.
+func forVars(e *env, f *generate.ForExpr) (name string, vars []string, err error) {
+	switch {
+	case f.Let != "":
+		if f.Var != "" || len(f.Vars) > 0 || len(f.Zip) > 0 || f.In != (generate.Generator{}) {
+			return "", nil, fmt.Errorf("for clause with .let cannot also have .var, .vars, .in, or .zip")
+		}
+		if f.Value == nil {
+			return "", nil, fmt.Errorf("for clause with .let must have .value")
+		}
+		name = f.Let
+	case len(f.Zip) > 0:
+		if f.Var != "" || len(f.Vars) > 0 || f.In != (generate.Generator{}) {
+			return "", nil, fmt.Errorf("for clause with .zip cannot also have .var, .vars, or .in")
+		}
+		for i := range f.Zip {
+			if f.Zip[i].Var == "" {
+				return "", nil, fmt.Errorf("zip item %d has no .var", i)
+			}
+			vars = append(vars, f.Zip[i].Var)
+		}
+		name = strings.Join(vars, ", ")
+	case f.Var != "" && len(f.Vars) > 0:
+		return "", nil, fmt.Errorf("for clause has both .var and .vars")
+	case f.Var != "":
+		name, vars = f.Var, nil
+	case len(f.Vars) > 0:
+		name, vars = strings.Join(f.Vars, ", "), f.Vars
+	default:
+		return "", nil, fmt.Errorf("for clause must have .var or .vars")
+	}
+
+	seen := map[string]bool{}
+	for ; e != nil; e = e.next {
+		seen[e.name] = true
+	}
+	names := vars
+	if vars == nil {
+		names = []string{name}
+	}
+	for _, v := range names {
+		if seen[v] {
+			return "", nil, fmt.Errorf("variable %q is bound more than once", v)
+		}
+		seen[v] = true
+	}
+	return name, vars, nil
+}
+
+// Output is a value instantiated from a template.
+type Output struct {
+	// Template is the name of the template; or "", if the
+	// comprehension yields a single template.
+	Template string
+	Value    interface{}
+}
+
+// Eval evaluates the comprehension, and returns the values
+// instantiated from its template or templates, in order.
 func (ev *Evaluator) Eval(expr *generate.ComprehensionSpec) ([]interface{}, error) {
+	outs, err := ev.EvalTemplates(expr)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(outs))
+	for i := range outs {
+		values[i] = outs[i].Value
+	}
+	return values, nil
+}
+
+// EvalTemplates evaluates the comprehension, and returns the values
+// instantiated from its template or templates, along with the name of
+// the template each came from.
+func (ev *Evaluator) EvalTemplates(expr *generate.ComprehensionSpec) ([]Output, error) {
+	ev.responses = nil
+	ev.queries = nil
+	ev.trees = nil
+	ev.artifacts = nil
 	generatedValues := make([]generated, len(expr.For))
 	var e *env
 	for i := range expr.For {
-		// TODO: detect duplicate var names
-		values, err := compileGenerator(e, &expr.For[i].In)
+		name, vars, err := forVars(e, &expr.For[i])
 		if err != nil {
 			return nil, err
 		}
-		name := expr.For[i].Var
-		e = &env{name: name, next: e}
+		var values generatorFunc
+		if zip := expr.For[i].Zip; len(zip) > 0 {
+			values, err = compileZip(e, zip)
+		} else if expr.For[i].Let != "" {
+			values, err = compileLet(e, expr.For[i].Value)
+		} else {
+			values, err = compileGenerator(e, &expr.For[i].In)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if vars == nil {
+			e = &env{name: name, next: e}
+		}
+		for _, v := range vars {
+			e = &env{name: v, next: e}
+		}
 
 		var when cel.Program
 		if w := expr.For[i].When; w != "" {
@@ -65,41 +233,113 @@ func (ev *Evaluator) Eval(expr *generate.ComprehensionSpec) ([]interface{}, erro
 				return nil, err
 			}
 		}
-		generatedValues[i] = generated{name: name, values: values, when: when}
+		generatedValues[i] = generated{name: name, vars: vars, values: values, when: when}
 	}
 
-	var template interface{}
-	if expr.Yield.Template == nil {
-		fmt.Printf("%#v\n", expr)
-		return nil, fmt.Errorf("nil template")
-	}
-	if err := json.Unmarshal(expr.Yield.Template.Raw, &template); err != nil {
+	templates, err := compileTemplates(e, &expr.Yield)
+	if err != nil {
 		return nil, err
 	}
+	return ev.instantiateTemplates(templates, map[string]interface{}{}, generatedValues, nil)
+}
 
-	t, err := compileTemplate(e, template)
-	if err != nil {
+// namedTemplate is a compiled template, with its name and condition,
+// if it has them.
+type namedTemplate struct {
+	name string
+	when cel.Program
+	t    *template
+}
+
+func compileTemplates(e *env, yield *generate.TemplateExpr) ([]namedTemplate, error) {
+	switch {
+	case yield.Template != nil && len(yield.Templates) > 0:
+		return nil, fmt.Errorf("yield has both .template and .templates")
+	case yield.Template != nil:
+		t, err := compileTemplateJSON(e, yield.Template.Raw)
+		if err != nil {
+			return nil, err
+		}
+		return []namedTemplate{{t: t}}, nil
+	case len(yield.Templates) == 0:
+		return nil, fmt.Errorf("yield must have .template or .templates")
+	}
+
+	templates := make([]namedTemplate, len(yield.Templates))
+	seen := map[string]bool{}
+	for i, nt := range yield.Templates {
+		if nt.Name == "" {
+			return nil, fmt.Errorf("template %d has no name", i)
+		}
+		if seen[nt.Name] {
+			return nil, fmt.Errorf("template name %q is used more than once", nt.Name)
+		}
+		seen[nt.Name] = true
+		if nt.Template == nil {
+			return nil, fmt.Errorf("template %q: nil template", nt.Name)
+		}
+		t, err := compileTemplateJSON(e, nt.Template.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("template %q: %w", nt.Name, err)
+		}
+		templates[i] = namedTemplate{name: nt.Name, t: t}
+		if nt.When != "" {
+			ce, err := e.celEnv()
+			if err != nil {
+				return nil, err
+			}
+			if templates[i].when, err = compileExpr(ce, nt.When); err != nil {
+				return nil, fmt.Errorf("template %q: %w", nt.Name, err)
+			}
+		}
+	}
+	return templates, nil
+}
+
+func compileTemplateJSON(e *env, raw []byte) (*template, error) {
+	var template interface{}
+	if err := json.Unmarshal(raw, &template); err != nil {
 		return nil, err
 	}
-	return ev.instantiateTemplate(t, map[string]interface{}{}, generatedValues, nil)
+	return compileTemplate(e, template)
 }
 
-func (ev *Evaluator) instantiateTemplate(t *template, ar map[string]interface{}, rest []generated, out []interface{}) ([]interface{}, error) {
+func (ev *Evaluator) instantiateTemplates(ts []namedTemplate, ar map[string]interface{}, rest []generated, out []Output) ([]Output, error) {
 	if len(rest) == 0 {
-		val, err := t.evaluate(ar)
-		if err != nil {
-			return nil, err
+		for _, t := range ts {
+			if t.when != nil {
+				ref, _, err := t.when.Eval(ar)
+				if err != nil {
+					return nil, fmt.Errorf("template %q: %w", t.name, err)
+				}
+				if !truthy(ref.Value()) {
+					continue
+				}
+			}
+			val, err := t.t.evaluate(ar)
+			if err != nil {
+				if t.name != "" {
+					return nil, fmt.Errorf("template %q: %w", t.name, err)
+				}
+				return nil, err
+			}
+			if val == omitted {
+				continue
+			}
+			out = append(out, Output{Template: t.name, Value: val})
 		}
-		return append(out, val), nil
+		return out, nil
 	}
 
 	g := rest[0]
-	values, err := g.values(ev, ar)
+	next, err := g.values(ev, ar)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("generator for %q: %w", g.name, err)
 	}
-	for i := range values {
-		ar[g.name] = values[i]
+	for val, ok := next(); ok; val, ok = next() {
+		if err := g.bind(ar, val); err != nil {
+			return nil, fmt.Errorf("binding %q: %w", g.name, err)
+		}
 
 		if g.when != nil {
 			ref, _, err := g.when.Eval(ar)
@@ -112,7 +352,7 @@ func (ev *Evaluator) instantiateTemplate(t *template, ar map[string]interface{},
 		}
 
 		var err error
-		out, err = ev.instantiateTemplate(t, ar, rest[1:], out)
+		out, err = ev.instantiateTemplates(ts, ar, rest[1:], out)
 		if err != nil {
 			return nil, err
 		}
@@ -120,6 +360,20 @@ func (ev *Evaluator) instantiateTemplate(t *template, ar map[string]interface{},
 	return out, nil
 }
 
+// getLocalObject fetches the named object from the namespace of the
+// comprehension.
+func (ev *Evaluator) getLocalObject(name string, obj client.Object) error {
+	if ev.Client == nil {
+		return fmt.Errorf("there is no client with which to fetch %s", name)
+	}
+	ctx, cancel := readContext()
+	defer cancel()
+	return readError(ev.Get(ctx, types.NamespacedName{
+		Namespace: ev.Namespace,
+		Name:      name,
+	}, obj))
+}
+
 // truthy here is anything that isn't `false`.
 func truthy(val interface{}) bool {
 	if b, ok := val.(bool); ok {
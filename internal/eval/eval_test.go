@@ -18,7 +18,10 @@ package eval
 
 import (
 	"fmt"
+	"strings"
+	"testing"
 
+	. "github.com/onsi/gomega"
 	"sigs.k8s.io/yaml"
 
 	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
@@ -188,6 +191,31 @@ for:
 	// 3 -> 12
 }
 
+// demonstrates a range generator with bounds taken from an outer
+// variable.
+func Example_eval_range() {
+	printEval(`
+yield:
+  template: ${name}-${i}
+for:
+- var: name
+  in:
+    list: [a, b]
+- var: i
+  in:
+    range:
+      start: 1
+      end: ${size(name) + 3}
+`)
+	// Output:
+	// a-1
+	// a-2
+	// a-3
+	// b-1
+	// b-2
+	// b-3
+}
+
 // demonstrates that you can interpolate into a `list:` generator to
 // flatten a list-of-lists value into the inner items.
 func Example_eval_flatten() {
@@ -211,6 +239,136 @@ for:
 	// 6
 }
 
+// demonstrates iterating over the entries of an object, and
+// destructuring each [key, value] pair into two variables.
+func Example_eval_map_entries() {
+	printEval(`
+yield:
+  template: ${team}=${quota}
+for:
+- var: quotas
+  in:
+    list: [{b: 20, a: 10}]
+- vars: [team, quota]
+  in:
+    list: ${quotas}
+`)
+	// Output:
+	// a=10
+	// b=20
+}
+
+// demonstrates destructuring the fields of each object generated.
+func Example_eval_destructure_fields() {
+	printEval(`
+yield:
+  template: ${name}:${port}
+for:
+- vars: [name, port]
+  in:
+    list:
+    - {name: http, port: 80, protocol: TCP}
+    - {name: https, port: 443, protocol: TCP}
+`)
+	// Output:
+	// http:80
+	// https:443
+}
+
+// demonstrates advancing generators together, rather than taking
+// every combination of their values. The zip stops when the shortest
+// generator runs out.
+func Example_eval_zip() {
+	printEval(`
+yield:
+  template: ${prefix}-${name}:${port}
+for:
+- var: prefix
+  in:
+    list: [dev, prod]
+- zip:
+  - var: name
+    in:
+      list: [http, https, metrics]
+  - var: port
+    in:
+      range:
+        start: 8080
+        end: 8082
+`)
+	// Output:
+	// dev-http:8080
+	// dev-https:8081
+	// prod-http:8080
+	// prod-https:8081
+}
+
+// demonstrates binding a derived value with let, which can then be
+// used in later clauses and in the template.
+func Example_eval_let() {
+	printEval(`
+yield:
+  template:
+    name: ${fullname}
+    labels: ${labels}
+for:
+- var: app
+  in:
+    list: [web, db]
+- let: fullname
+  value: ${"shop-" + app}
+- let: labels
+  value:
+    app: ${fullname}
+    tier: '${app == "db" ? "data" : "frontend"}'
+  when: labels.tier == "frontend"
+`)
+	// Output:
+	// map[labels:map[app:shop-web tier:frontend] name:shop-web]
+}
+
+// demonstrates yielding several templates for each value, one of
+// them conditionally.
+func Example_eval_templates() {
+	printEval(`
+yield:
+  templates:
+  - name: deployment
+    template: deployment/${app.name}
+  - name: ingress
+    when: app.public
+    template: ingress/${app.name}
+for:
+- var: app
+  in:
+    list:
+    - {name: web, public: true}
+    - {name: db, public: false}
+`)
+	// Output:
+	// deployment/web
+	// ingress/web
+	// deployment/db
+}
+
+// demonstrates that when the whole template has a false `$if`, it
+// results in nothing.
+func Example_eval_if_template() {
+	printEval(`
+yield:
+  template:
+    $if: ${x != "b"}
+    name: ${x}
+for:
+- var: x
+  in:
+    list: [a, b, c]
+`)
+	// Output:
+	// map[name:a]
+	// map[name:c]
+}
+
 // demonstrates that you can issue an HTTP request with interpolated
 // parameters (in this case, the repo comes from a literal list). This
 // relies on the httptest server run in main_test.go.
@@ -247,3 +405,271 @@ yield:
 	// https://api.github.com/repos/fluxcd/flux2/pulls/1620
 	// https://api.github.com/repos/fluxcd/flux2/pulls/1350
 }
+
+func Test_eval_errors(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		spec string
+		err  string
+	}{
+		{
+			name: "list expression of the wrong type",
+			spec: `
+for:
+- var: x
+  in:
+    list: ${"foo"}
+`,
+			err: "expected a list or an object",
+		},
+		{
+			name: "list expression evaluating to the wrong type",
+			spec: `
+for:
+- var: xs
+  in:
+    list: [foo]
+- var: x
+  in:
+    list: ${xs}
+`,
+			err: "evaluated to a value of type string",
+		},
+		{
+			name: "both var and vars",
+			spec: `
+for:
+- var: x
+  vars: [a, b]
+  in:
+    list: []
+`,
+			err: "both .var and .vars",
+		},
+		{
+			name: "variable bound twice",
+			spec: `
+for:
+- var: x
+  in:
+    list: []
+- vars: [a, x]
+  in:
+    list: []
+`,
+			err: `"x" is bound more than once`,
+		},
+		{
+			name: "list of the wrong length",
+			spec: `
+for:
+- vars: [a, b]
+  in:
+    list: [[1, 2, 3]]
+`,
+			err: "list of 3 items into 2 variables",
+		},
+		{
+			name: "object without the field",
+			spec: `
+for:
+- vars: [a, b]
+  in:
+    list: [{a: 1}]
+`,
+			err: `without the field "b"`,
+		},
+		{
+			name: "value that can't be destructured",
+			spec: `
+for:
+- vars: [a, b]
+  in:
+    list: [1]
+`,
+			err: "cannot destructure a value of type float64",
+		},
+		{
+			name: "zip with var",
+			spec: `
+for:
+- var: x
+  zip:
+  - var: a
+    in:
+      list: []
+`,
+			err: "cannot also have .var",
+		},
+		{
+			name: "zip binding a variable twice",
+			spec: `
+for:
+- zip:
+  - var: a
+    in:
+      list: []
+  - var: a
+    in:
+      list: []
+`,
+			err: `"a" is bound more than once`,
+		},
+		{
+			name: "let with in",
+			spec: `
+for:
+- let: x
+  value: 1
+  in:
+    list: []
+`,
+			err: "cannot also have",
+		},
+		{
+			name: "let without value",
+			spec: `
+for:
+- let: x
+`,
+			err: "must have .value",
+		},
+		{
+			name: "template and templates",
+			spec: `
+yield:
+  template: x
+  templates:
+  - name: a
+    template: y
+`,
+			err: "both .template and .templates",
+		},
+		{
+			name: "duplicate template names",
+			spec: `
+yield:
+  templates:
+  - name: a
+    template: x
+  - name: a
+    template: y
+`,
+			err: `"a" is used more than once`,
+		},
+		{
+			name: "merging something other than an object",
+			spec: `
+yield:
+  template:
+    $merge: ${x}
+for:
+- var: x
+  in:
+    list: [[1]]
+`,
+			err: "$merge value must be an object",
+		},
+		{
+			name: "splicing something other than a list",
+			spec: `
+yield:
+  template:
+  - $splice: ${x}
+for:
+- var: x
+  in:
+    list: [{a: 1}]
+`,
+			err: "$splice value must be a list",
+		},
+		{
+			name: "$value with other fields",
+			spec: `
+yield:
+  template:
+    replicas: {$value: 1, extra: 2}
+for:
+- var: x
+  in:
+    list: [1]
+`,
+			err: "$value cannot be given with fields other than $if",
+		},
+		{
+			name: "$splice with other fields",
+			spec: `
+yield:
+  template:
+  - {$splice: [1], extra: 2}
+for:
+- var: x
+  in:
+    list: [1]
+`,
+			err: "$splice cannot be given with fields other than $if",
+		},
+		{
+			name: "non-string value for a string field",
+			spec: `
+for:
+- var: x
+  in:
+    configMap:
+      name: ${1}
+`,
+			err: "expected expression to evaluate to a string",
+		},
+		{
+			name: "non-string value for a label",
+			spec: `
+for:
+- var: x
+  in:
+    query:
+      apiVersion: v1
+      kind: ConfigMap
+      matchLabels:
+        app: ${1}
+`,
+			err: `expected expression for "app" to evaluate to a string`,
+		},
+	} {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			var spec generate.ComprehensionSpec
+			if !strings.Contains(tc.spec, "yield:") {
+				tc.spec += "yield: {template: x}\n"
+			}
+			g.Expect(yaml.Unmarshal([]byte(tc.spec), &spec)).To(Succeed())
+			_, err := (&Evaluator{}).Eval(&spec)
+			g.Expect(err).To(MatchError(ContainSubstring(tc.err)))
+		})
+	}
+}
+
+func Test_EvalTemplates(t *testing.T) {
+	g := NewWithT(t)
+	var spec generate.ComprehensionSpec
+	g.Expect(yaml.Unmarshal([]byte(`
+yield:
+  templates:
+  - name: first
+    template: ${x}
+  - name: second
+    when: x > 1.0
+    template: ${x * 10.0}
+for:
+- var: x
+  in:
+    list: [1, 2]
+`), &spec)).To(Succeed())
+	outs, err := (&Evaluator{}).EvalTemplates(&spec)
+	g.Expect(err).NotTo(HaveOccurred())
+	g.Expect(outs).To(Equal([]Output{
+		{Template: "first", Value: float64(1)},
+		{Template: "first", Value: float64(2)},
+		{Template: "second", Value: float64(20)},
+	}))
+}
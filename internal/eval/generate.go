@@ -17,36 +17,89 @@ limitations under the License.
 package eval
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"math"
+	"strconv"
 	"sync"
 
+	"github.com/google/cel-go/cel"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensions "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	helpers "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
 )
 
-type generatorFunc func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error)
+// generatorFunc gives the values of a generator, given the values of
+// the variables in scope.
+type generatorFunc func(ev *Evaluator, ar map[string]interface{}) (iterator, error)
+
+// iterator gives values one at a time; ok is false when there are no
+// more values.
+type iterator func() (val interface{}, ok bool)
+
+// eagerGeneratorFunc is a generator that produces all its values at
+// once.
+type eagerGeneratorFunc func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error)
 
 func compileGenerator(e *env, expr *generate.Generator) (generatorFunc, error) {
 	switch {
 	case expr.List != nil:
-		return compileList(e, expr)
+		return eager(compileList(e, expr))
 	case expr.Query != nil:
-		return compileQuery(e, expr)
+		return eager(compileQuery(e, expr))
 	case expr.Request != nil:
-		return compileRequest(e, expr)
+		return eager(compileRequest(e, expr))
+	case expr.Range != nil:
+		return compileRange(e, expr)
+	case expr.Git != nil:
+		return eager(compileGit(e, expr))
+	case expr.Source != nil:
+		return eager(compileSource(e, expr))
+	case expr.ConfigMap != nil:
+		return eager(compileObjectData(e, expr.ConfigMap, configMapData))
+	case expr.Secret != nil:
+		return eager(compileObjectData(e, expr.Secret, secretData))
 	default:
 		return nil, fmt.Errorf("unknown generator %#v", expr)
 	}
 }
 
+// eager adapts an eagerGeneratorFunc to be a generatorFunc. It takes
+// an error so that it can wrap a compile func directly.
+func eager(gen eagerGeneratorFunc, err error) (generatorFunc, error) {
+	if err != nil {
+		return nil, err
+	}
+	return func(ev *Evaluator, ar map[string]interface{}) (iterator, error) {
+		values, err := gen(ev, ar)
+		if err != nil {
+			return nil, err
+		}
+		return sliceIterator(values), nil
+	}, nil
+}
+
+func sliceIterator(values []interface{}) iterator {
+	i := 0
+	return func() (interface{}, bool) {
+		if i >= len(values) {
+			return nil, false
+		}
+		i++
+		return values[i-1], true
+	}
+}
+
 // helpers
 
 // replaceStrPointer gives a replaceFunc that will replace the string
@@ -54,12 +107,13 @@ func compileGenerator(e *env, expr *generate.Generator) (generatorFunc, error) {
 // be a string, which is sometimes the case when interpolating fields
 // of a generator.
 func replaceStrPointer(p *string) replaceFunc {
-	return func(v interface{}) {
-		if s, ok := v.(string); ok {
-			*p = s
-			return
+	return func(v interface{}) error {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected expression to evaluate to a string, but got a %T", v)
 		}
-		panic("tried to replace a string with a non-string value")
+		*p = s
+		return nil
 	}
 }
 
@@ -67,45 +121,76 @@ func replaceStrPointer(p *string) replaceFunc {
 // value at a key in a map. This is necessary for e.g., matchLabels in
 // the query generator, which must have string values.
 func replaceStrMap(m map[string]string, k string) replaceFunc {
-	return func(v interface{}) {
-		if s, ok := v.(string); ok {
-			m[k] = s
+	return func(v interface{}) error {
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("expected expression for %q to evaluate to a string, but got a %T", k, v)
 		}
-		panic("tried to replace a string in a map with a non-string value")
+		m[k] = s
+		return nil
 	}
 }
 
 // === list:
 
-func compileList(e *env, expr *generate.Generator) (generatorFunc, error) {
+func compileList(e *env, expr *generate.Generator) (eagerGeneratorFunc, error) {
 	var itemsExpr interface{}
 	if err := json.Unmarshal(expr.List.Raw, &itemsExpr); err != nil {
 		return nil, fmt.Errorf("cannot decode list value: %w", err)
 	}
-	// there's two possible acceptable values:
+	// there's three possible acceptable values:
 	// - a list of items, each of which we migth interpolate into
-	// - a single string-valued item, which must evaluate to a list
+	// - an object, whose entries are generated as [key, value]
+	// - a single string-valued item, which must evaluate to a list or
+	//   an object
 	switch items := itemsExpr.(type) {
 	case string:
 		ce, err := e.celEnv()
 		if err != nil {
 			return nil, err
 		}
-		var list []interface{}
-		eval, err := compileString(ce, items, func(val interface{}) {
-			list = val.([]interface{}) // FIXME this lets it panic
-		})
+		prog, err := compileCollectionExpr(ce, items)
 		if err != nil {
 			return nil, err
 		}
-		if eval == nil {
-			return nil, fmt.Errorf("list must evaluate to a list value, and this is a string value")
-		}
 		return func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error) {
-			if err := eval(ar); err != nil {
+			ref, _, err := prog.Eval(ar)
+			if err != nil {
 				return nil, err
 			}
-			return list, nil
+			val, err := nativeValue(ref)
+			if err != nil {
+				return nil, err
+			}
+			switch v := val.(type) {
+			case []interface{}:
+				return v, nil
+			case map[string]interface{}:
+				return mapEntries(v), nil
+			default:
+				return nil, fmt.Errorf("list expression evaluated to a value of type %T; expected a list or an object", val)
+			}
+		}, nil
+	case map[string]interface{}:
+		ce, err := e.celEnv()
+		if err != nil {
+			return nil, err
+		}
+		var value interface{} = items
+		evals, err := compileMap(ce, items, replacePointer(&value))
+		if err != nil {
+			return nil, err
+		}
+		return func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error) {
+			for i := range evals {
+				if err := evals[i](ar); err != nil {
+					return nil, err
+				}
+			}
+			if m, ok := deepcopy(value).(map[string]interface{}); ok {
+				return mapEntries(m), nil
+			}
+			return nil, nil // the object was omitted
 		}, nil
 	case []interface{}:
 		if len(items) > 0 {
@@ -113,7 +198,11 @@ func compileList(e *env, expr *generate.Generator) (generatorFunc, error) {
 			if err != nil {
 				return nil, err
 			}
-			evals, err := compileSlice(ce, items)
+			var value interface{} = items
+			evals, err := compileSlice(ce, items, replacePointer(&value))
+			if err != nil {
+				return nil, err
+			}
 			if len(evals) > 0 {
 				return func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error) {
 					for i := range evals {
@@ -121,7 +210,7 @@ func compileList(e *env, expr *generate.Generator) (generatorFunc, error) {
 							return nil, err
 						}
 					}
-					return deepcopy(items).([]interface{}), nil
+					return deepcopy(value).([]interface{}), nil
 				}, nil
 			}
 		}
@@ -130,26 +219,259 @@ func compileList(e *env, expr *generate.Generator) (generatorFunc, error) {
 			return items, nil
 		}, nil
 	}
-	return nil, fmt.Errorf("expected list, or expression evaluating to a list")
+	return nil, fmt.Errorf("expected list, object, or expression evaluating to a list or object")
 }
 
-// === query
+// compileCollectionExpr compiles a list generator given as an
+// expression. If the type of the expression is known, it's checked
+// here, so that e.g., `${"foo"}` fails before anything is evaluated.
+func compileCollectionExpr(ce *cel.Env, s string) (cel.Program, error) {
+	parts, err := parseInterpolation(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) != 1 || parts[0].expr == "" {
+		return nil, fmt.Errorf("list must evaluate to a list or object value, and this is a string value")
+	}
+	ast, issues := ce.Compile(parts[0].expr)
+	if err := issues.Err(); err != nil {
+		return nil, err
+	}
+	switch t := ast.ResultType(); t.TypeKind.(type) {
+	case *exprpb.Type_ListType_, *exprpb.Type_MapType_, *exprpb.Type_Dyn, *exprpb.Type_TypeParam:
+	default:
+		if t.GetWellKnown() != exprpb.Type_ANY {
+			return nil, fmt.Errorf("list expression %q has type %s; expected a list or an object", parts[0].expr, ast.OutputType())
+		}
+	}
+	return ce.Program(ast)
+}
+
+// mapEntries gives the entries of a map as [key, value] pairs, in
+// order of key.
+func mapEntries(m map[string]interface{}) []interface{} {
+	entries := make([]interface{}, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		entries = append(entries, []interface{}{k, m[k]})
+	}
+	return entries
+}
+
+// === zip
 
-func compileQuery(e *env, expr *generate.Generator) (generatorFunc, error) {
+// compileZip compiles the generators of a zip clause, which are
+// advanced together. Each value generated is a list with a value from
+// each generator, to be destructured into the variables of the zip.
+func compileZip(e *env, items []generate.ZipItem) (generatorFunc, error) {
+	gens := make([]generatorFunc, len(items))
+	for i := range items {
+		gen, err := compileGenerator(e, &items[i].In)
+		if err != nil {
+			return nil, fmt.Errorf("zip item %q: %w", items[i].Var, err)
+		}
+		gens[i] = gen
+	}
+
+	return func(ev *Evaluator, ar map[string]interface{}) (iterator, error) {
+		nexts := make([]iterator, len(gens))
+		for i := range gens {
+			next, err := gens[i](ev, ar)
+			if err != nil {
+				return nil, fmt.Errorf("zip item %q: %w", items[i].Var, err)
+			}
+			nexts[i] = next
+		}
+		return func() (interface{}, bool) {
+			values := make([]interface{}, len(nexts))
+			for i := range nexts {
+				val, ok := nexts[i]()
+				if !ok {
+					return nil, false
+				}
+				values[i] = val
+			}
+			return values, true
+		}, nil
+	}, nil
+}
+
+// === let
+
+// compileLet compiles the value of a let clause into a generator
+// which generates just that value.
+func compileLet(e *env, value *apiextensions.JSON) (generatorFunc, error) {
+	var valueExpr interface{}
+	if err := json.Unmarshal(value.Raw, &valueExpr); err != nil {
+		return nil, fmt.Errorf("cannot decode let value: %w", err)
+	}
+	t, err := compileTemplate(e, valueExpr)
+	if err != nil {
+		return nil, err
+	}
+	return func(_ *Evaluator, ar map[string]interface{}) (iterator, error) {
+		val, err := t.evaluate(ar)
+		if err != nil {
+			return nil, err
+		}
+		if val == omitted {
+			return sliceIterator(nil), nil
+		}
+		return sliceIterator([]interface{}{val}), nil
+	}, nil
+}
+
+// === range
+
+func compileRange(e *env, expr *generate.Generator) (generatorFunc, error) {
 	ce, err := e.celEnv()
 	if err != nil {
 		return nil, err
 	}
+	start, err := compileRangeBound(ce, "start", expr.Range.Start, 0)
+	if err != nil {
+		return nil, err
+	}
+	end, err := compileRangeBound(ce, "end", &expr.Range.End, 0)
+	if err != nil {
+		return nil, err
+	}
+	step, err := compileRangeBound(ce, "step", expr.Range.Step, 1)
+	if err != nil {
+		return nil, err
+	}
 
-	query := *expr.Query
-	// copy MatchLabels, otherwise we might overwrite the original
-	if query.MatchLabels != nil {
-		copy := map[string]string{}
-		for k, v := range query.MatchLabels {
-			copy[k] = v
+	return func(ev *Evaluator, ar map[string]interface{}) (iterator, error) {
+		from, err := start(ar)
+		if err != nil {
+			return nil, err
+		}
+		to, err := end(ar)
+		if err != nil {
+			return nil, err
 		}
-		query.MatchLabels = copy
+		by, err := step(ar)
+		if err != nil {
+			return nil, err
+		}
+		if by == 0 {
+			return nil, fmt.Errorf("range step cannot be zero")
+		}
+		count := rangeCount(from, to, by)
+		limit := uint64(defaultMaxRangeItems)
+		if ev.MaxItems > 0 {
+			limit = uint64(ev.MaxItems)
+		}
+		if count > limit {
+			return nil, fmt.Errorf("range would generate %d values, which exceeds the limit of %d", count, limit)
+		}
+		// The values are produced as they are asked for, rather than
+		// all at once, so that a large range doesn't use lots of
+		// memory. Counting them, rather than comparing against the
+		// end, means stepping never overflows.
+		i := from
+		return func() (interface{}, bool) {
+			if count == 0 {
+				return nil, false
+			}
+			val := i
+			if count--; count > 0 {
+				i += by
+			}
+			return val, true
+		}, nil
+	}, nil
+}
+
+// defaultMaxRangeItems is the most values a range generator can
+// generate, if the evaluator doesn't say otherwise.
+const defaultMaxRangeItems = 10000
+
+// rangeCount is the number of values from `from`, up to but not
+// including `to`, in steps of `by`. The arithmetic is unsigned so
+// that it's correct for any int64 values.
+func rangeCount(from, to, by int64) uint64 {
+	var dist, step uint64
+	switch {
+	case by > 0 && to > from:
+		dist, step = uint64(to)-uint64(from), uint64(by)
+	case by < 0 && to < from:
+		dist, step = uint64(from)-uint64(to), -uint64(by)
+	default:
+		return 0
+	}
+	count := dist / step
+	if dist%step != 0 {
+		count++
+	}
+	return count
+}
+
+// rangeBoundFunc gives the value of one of the start, end or step of
+// a range, given the values of the variables in scope.
+type rangeBoundFunc func(ar map[string]interface{}) (int64, error)
+
+func compileRangeBound(ce *cel.Env, field string, bound *intstr.IntOrString, def int64) (rangeBoundFunc, error) {
+	constant := func(n int64) rangeBoundFunc {
+		return func(map[string]interface{}) (int64, error) {
+			return n, nil
+		}
+	}
+	switch {
+	case bound == nil:
+		return constant(def), nil
+	case bound.Type == intstr.Int:
+		return constant(int64(bound.IntVal)), nil
+	}
+
+	var val interface{}
+	eval, err := compileString(ce, bound.StrVal, func(v interface{}) error {
+		val = v
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if eval == nil {
+		n, err := strconv.ParseInt(bound.StrVal, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("range %s must be an integer, or evaluate to one", field)
+		}
+		return constant(n), nil
 	}
+	return func(ar map[string]interface{}) (int64, error) {
+		if err := eval(ar); err != nil {
+			return 0, err
+		}
+		switch n := val.(type) {
+		case int64:
+			return n, nil
+		case uint64:
+			if n <= math.MaxInt64 {
+				return int64(n), nil
+			}
+		case float64:
+			if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+				return int64(n), nil
+			}
+		case string:
+			if i, err := strconv.ParseInt(n, 10, 64); err == nil {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("range %s must evaluate to an integer, but got %v", field, val)
+	}, nil
+}
+
+// === query
+
+func compileQuery(e *env, expr *generate.Generator) (eagerGeneratorFunc, error) {
+	ce, err := e.celEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// copy the query, otherwise we might overwrite the original
+	query := expr.Query.DeepCopy()
 
 	var evals []evaluationFunc
 
@@ -165,9 +487,14 @@ func compileQuery(e *env, expr *generate.Generator) (generatorFunc, error) {
 	if err != nil {
 		return nil, err
 	}
+	namespaceEvals, err := compileAny(ce, query.Namespace, replaceStrPointer(&query.Namespace))
+	if err != nil {
+		return nil, err
+	}
 	evals = append(evals, apiVersionEvals...)
 	evals = append(evals, kindEvals...)
 	evals = append(evals, nameEvals...)
+	evals = append(evals, namespaceEvals...)
 
 	// Having an expression in a value can mutate that entry, but it
 	// can't create or delete entries; so, it's OK to always mutate
@@ -181,6 +508,25 @@ func compileQuery(e *env, expr *generate.Generator) (generatorFunc, error) {
 			evals = append(evals, eval)
 		}
 	}
+	for i := range query.MatchExpressions {
+		values := query.MatchExpressions[i].Values
+		for j := range values {
+			eval, err := compileString(ce, values[j], replaceStrPointer(&values[j]))
+			if err != nil {
+				return nil, err
+			}
+			if eval != nil {
+				evals = append(evals, eval)
+			}
+		}
+	}
+	fieldSelectorEval, err := compileString(ce, query.FieldSelector, replaceStrPointer(&query.FieldSelector))
+	if err != nil {
+		return nil, err
+	}
+	if fieldSelectorEval != nil {
+		evals = append(evals, fieldSelectorEval)
+	}
 
 	if len(evals) == 0 {
 		// nothing to evaluate; just evaluate the query and use the results.
@@ -204,103 +550,172 @@ func compileQuery(e *env, expr *generate.Generator) (generatorFunc, error) {
 				return nil, err
 			}
 		}
-		return ev.generateObjectQuery(&query)
+		return ev.generateObjectQuery(query)
 	}, nil
 }
 
 func (ev *Evaluator) generateObjectQuery(gen *generate.ObjectQuery) ([]interface{}, error) {
-	switch {
-	case gen.MatchLabels == nil && gen.Name != "":
-		var obj unstructured.Unstructured
-		obj.SetAPIVersion(gen.APIVersion)
-		obj.SetKind(gen.Kind)
-		if err := ev.Get(context.TODO(), types.NamespacedName{
-			Name: gen.Name,
-		}, &obj); err != nil {
-			return nil, fmt.Errorf("unable to fetch named object: %w", err)
+	namespaces, err := ev.queryNamespaces(gen)
+	if err != nil {
+		return nil, err
+	}
+	var out []interface{}
+	for _, namespace := range namespaces {
+		remaining := 0
+		if gen.Limit > 0 {
+			remaining = gen.Limit - len(out)
+			if remaining <= 0 {
+				break
+			}
 		}
-		return []interface{}{obj.Object}, nil
+		objs, err := ev.queryInNamespace(gen, namespace, len(namespaces) > 1, remaining)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, objs...)
+	}
+	return out, nil
+}
 
-	case gen.Name == "" && gen.MatchLabels != nil:
-		var objs unstructured.UnstructuredList
-		objs.SetAPIVersion(gen.APIVersion)
-		// unstructuredClient lets you give the item kind rather than the list kind
-		objs.SetKind(gen.Kind)
-		selector, err := helpers.LabelSelectorAsSelector(&helpers.LabelSelector{MatchLabels: gen.MatchLabels})
+// listPageSize is the most objects asked for in each List request;
+// more are fetched by continuing the list.
+var listPageSize = 500
+
+// queryNamespaces gives the namespaces in which to run the query,
+// having checked that it's allowed to look in them. The namespace ""
+// stands for all namespaces.
+func (ev *Evaluator) queryNamespaces(gen *generate.ObjectQuery) ([]string, error) {
+	switch {
+	case gen.NamespaceSelector != nil:
+		if gen.Namespace != "" {
+			return nil, fmt.Errorf("objects query generator cannot specify both .namespace and .namespaceSelector")
+		}
+		if !ev.AllowCrossNamespace {
+			return nil, fmt.Errorf("objects query generator uses .namespaceSelector, but cross-namespace queries are not allowed")
+		}
+		selector, err := helpers.LabelSelectorAsSelector(gen.NamespaceSelector)
 		if err != nil {
 			return nil, err
 		}
-		if err := ev.List(context.TODO(), &objs, &client.ListOptions{LabelSelector: selector}); err != nil {
-			return nil, fmt.Errorf("unable to fetch selected objects: %w", err)
+		// Objects can be listed across all namespaces in one go; but
+		// to get a named object, each namespace must be asked.
+		if selector.Empty() && gen.Name == "" {
+			return []string{helpers.NamespaceAll}, nil
 		}
-		if len(objs.Items) == 0 {
-			return nil, nil
+		var namespaces corev1.NamespaceList
+		reader, _ := ev.readerFor(corev1.SchemeGroupVersion.WithKind("Namespace"), "")
+		ctx, cancel := readContext()
+		defer cancel()
+		if err := reader.List(ctx, &namespaces, client.MatchingLabelsSelector{Selector: selector}); err != nil {
+			return nil, fmt.Errorf("unable to fetch selected namespaces: %w", readError(err))
 		}
-		out := make([]interface{}, len(objs.Items))
-		for i := range objs.Items {
-			out[i] = interface{}(objs.Items[i].Object)
+		ev.recordQuery(Query{
+			GVK:      corev1.SchemeGroupVersion.WithKind("Namespace"),
+			Selector: selector,
+		})
+		names := make([]string, len(namespaces.Items))
+		for i := range namespaces.Items {
+			names[i] = namespaces.Items[i].Name
 		}
-		return out, nil
+		return names, nil
+	case gen.Namespace != "" && gen.Namespace != ev.Namespace:
+		if !ev.AllowCrossNamespace {
+			return nil, fmt.Errorf("objects query generator uses namespace %q, but cross-namespace queries are not allowed", gen.Namespace)
+		}
+		return []string{gen.Namespace}, nil
 	default:
-		return nil, fmt.Errorf("objects query generator must specify one of .name or .matchLabels")
+		return []string{ev.Namespace}, nil
 	}
 }
 
-// == request
-
-func compileRequest(e *env, expr *generate.Generator) (generatorFunc, error) {
-	request := expr.Request.DeepCopy()
-	ce, err := e.celEnv()
-	if err != nil {
-		return nil, err
-	}
-
-	var evals []evaluationFunc
-	urlEval, err := compileString(ce, request.URL, replaceStrPointer(&request.URL))
-	if err != nil {
-		return nil, err
-	}
-	if urlEval != nil {
-		evals = append(evals, urlEval)
-	}
+// queryInNamespace runs the query in a single namespace. If
+// ignoreMissing is true, a named object that doesn't exist is
+// skipped, rather than being an error. If limit is positive, no more
+// than that many objects are returned.
+func (ev *Evaluator) queryInNamespace(gen *generate.ObjectQuery, namespace string, ignoreMissing bool, limit int) ([]interface{}, error) {
+	selecting := gen.MatchLabels != nil || len(gen.MatchExpressions) > 0 || gen.FieldSelector != ""
+	gvk := schema.FromAPIVersionAndKind(gen.APIVersion, gen.Kind)
+	reader, cached := ev.readerFor(gvk, gen.FieldSelector)
+	switch {
+	case !selecting && gen.Name != "":
+		var obj unstructured.Unstructured
+		obj.SetGroupVersionKind(gvk)
+		ctx, cancel := readContext()
+		defer cancel()
+		err := reader.Get(ctx, types.NamespacedName{
+			Namespace: namespace,
+			Name:      gen.Name,
+		}, &obj)
+		// An object that's missing may yet appear, so that's worth
+		// recording too.
+		if err == nil || apierrors.IsNotFound(err) {
+			ev.recordQuery(Query{GVK: gvk, Namespace: namespace, Name: gen.Name})
+		}
+		if err != nil {
+			if ignoreMissing && apierrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unable to fetch named object: %w", readError(err))
+		}
+		return []interface{}{obj.Object}, nil
 
-	for i := range request.Headers {
-		headerEval, err := compileString(ce, request.Headers[i], replaceStrPointer(&request.Headers[i]))
+	case gen.Name == "" && selecting:
+		selector, err := helpers.LabelSelectorAsSelector(&helpers.LabelSelector{
+			MatchLabels:      gen.MatchLabels,
+			MatchExpressions: gen.MatchExpressions,
+		})
 		if err != nil {
 			return nil, err
 		}
-		if headerEval != nil {
-			evals = append(evals, headerEval)
+		listOpts := &client.ListOptions{
+			Namespace:     namespace,
+			LabelSelector: selector,
 		}
-	}
-
-	// TODO memoised value, if there is nothing to evaluate.
-	return func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error) {
-		for i := range evals {
-			if err := evals[i](ar); err != nil {
-				return nil, err
+		if gen.FieldSelector != "" {
+			listOpts.FieldSelector, err = fields.ParseSelector(gen.FieldSelector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid field selector: %w", err)
 			}
 		}
 
-		resp, err := http.Get(request.URL) // TODO headers
-		if err != nil {
-			return nil, fmt.Errorf("could not fetch generator URL: %w", err)
-		}
-		if resp.StatusCode != http.StatusOK {
-			return nil, fmt.Errorf("got status %d", resp.StatusCode)
+		// List in chunks, so that a query for a kind with lots of
+		// objects doesn't result in one enormous response. A cache
+		// has everything in memory already, and doesn't give
+		// continuations, so there's no chunking when reading from
+		// one.
+		pageSize := listPageSize
+		if cached {
+			pageSize = 0
 		}
-		defer resp.Body.Close()
-		var result []interface{}
-		jd := json.NewDecoder(resp.Body)
+		var out []interface{}
 		for {
-			var val interface{}
-			if err := jd.Decode(&val); err == io.EOF {
+			listOpts.Limit = int64(pageSize)
+			if remaining := limit - len(out); limit > 0 && (pageSize == 0 || remaining < pageSize) {
+				listOpts.Limit = int64(remaining)
+			}
+			var objs unstructured.UnstructuredList
+			// unstructuredClient lets you give the item kind rather than the list kind
+			objs.SetGroupVersionKind(gvk)
+			ctx, cancel := readContext()
+			err := reader.List(ctx, &objs, listOpts)
+			cancel()
+			if err != nil {
+				return nil, fmt.Errorf("unable to fetch selected objects: %w", readError(err))
+			}
+			for i := range objs.Items {
+				out = append(out, interface{}(objs.Items[i].Object))
+			}
+			listOpts.Continue = objs.GetContinue()
+			if listOpts.Continue == "" || (limit > 0 && len(out) >= limit) {
 				break
-			} else if err != nil {
-				return nil, fmt.Errorf("cannot decode response: %w", err)
 			}
-			result = append(result, val)
 		}
-		return result, nil
-	}, nil
+		ev.recordQuery(Query{GVK: gvk, Namespace: namespace, Selector: selector})
+		if limit > 0 && len(out) > limit {
+			out = out[:limit]
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("objects query generator must specify either .name, or any of .matchLabels, .matchExpressions and .fieldSelector")
+	}
 }
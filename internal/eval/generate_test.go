@@ -39,11 +39,29 @@ func expectGeneratorItems(g Gomega, y string, ev *Evaluator, match types.GomegaM
 	generate, err := compileGenerator(e, &gen)
 	g.ExpectWithOffset(1, err).NotTo(HaveOccurred())
 
-	objs, err := generate(ev, map[string]interface{}{})
+	next, err := generate(ev, map[string]interface{}{})
 	g.ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	var objs []interface{}
+	for obj, ok := next(); ok; obj, ok = next() {
+		objs = append(objs, obj)
+	}
 	g.ExpectWithOffset(1, objs).To(match)
 }
 
+// expectGeneratorError runs the generator, expecting it to fail, and
+// returns the error for further inspection.
+func expectGeneratorError(g Gomega, y string, ev *Evaluator) error {
+	var gen generate.Generator
+	g.ExpectWithOffset(1, yaml.Unmarshal([]byte(y), &gen)).To(Succeed())
+	e := &env{}
+	generate, err := compileGenerator(e, &gen)
+	g.ExpectWithOffset(1, err).NotTo(HaveOccurred())
+
+	_, err = generate(ev, map[string]interface{}{})
+	g.ExpectWithOffset(1, err).To(HaveOccurred())
+	return err
+}
+
 func Test_list(t *testing.T) {
 
 	t.Run("list generator with objects", func(t *testing.T) {
@@ -70,6 +88,119 @@ list:
 	})
 }
 
+func Test_range(t *testing.T) {
+	t.Run("counts up", func(t *testing.T) {
+		g := NewWithT(t)
+		const generatorYAML = `
+range:
+  end: 3
+`
+		expectGeneratorItems(g, generatorYAML, &Evaluator{}, Equal([]interface{}{
+			int64(0), int64(1), int64(2),
+		}))
+	})
+
+	t.Run("counts down, in steps", func(t *testing.T) {
+		g := NewWithT(t)
+		const generatorYAML = `
+range:
+  start: "10"
+  end: 0
+  step: ${-3}
+`
+		expectGeneratorItems(g, generatorYAML, &Evaluator{}, Equal([]interface{}{
+			int64(10), int64(7), int64(4), int64(1),
+		}))
+	})
+
+	t.Run("is empty when the end is before the start", func(t *testing.T) {
+		g := NewWithT(t)
+		const generatorYAML = `
+range:
+  start: 5
+  end: 1
+`
+		expectGeneratorItems(g, generatorYAML, &Evaluator{}, BeEmpty())
+	})
+
+	t.Run("refuses a step of zero", func(t *testing.T) {
+		g := NewWithT(t)
+		const generatorYAML = `
+range:
+  end: 5
+  step: 0
+`
+		expectGeneratorError(g, generatorYAML, &Evaluator{})
+	})
+
+	t.Run("refuses a bound that's not a number", func(t *testing.T) {
+		g := NewWithT(t)
+		const generatorYAML = `
+range:
+  end: ${"five"}
+`
+		expectGeneratorError(g, generatorYAML, &Evaluator{})
+	})
+
+	t.Run("produces values lazily", func(t *testing.T) {
+		g := NewWithT(t)
+		var gen generate.Generator
+		g.Expect(yaml.Unmarshal([]byte(`
+range:
+  end: ${1000000000}
+`), &gen)).To(Succeed())
+		generate, err := compileGenerator(&env{}, &gen)
+		g.Expect(err).NotTo(HaveOccurred())
+		next, err := generate(&Evaluator{MaxItems: 1000000000}, map[string]interface{}{})
+		g.Expect(err).NotTo(HaveOccurred())
+		for i := int64(0); i < 3; i++ {
+			val, ok := next()
+			g.Expect(ok).To(BeTrue())
+			g.Expect(val).To(Equal(i))
+		}
+	})
+
+	t.Run("refuses too many values", func(t *testing.T) {
+		g := NewWithT(t)
+		expectGeneratorError(g, `
+range:
+  end: ${1000000000000000}
+`, &Evaluator{})
+		expectGeneratorError(g, `
+range:
+  end: 10
+`, &Evaluator{MaxItems: 5})
+	})
+
+	t.Run("does not overflow", func(t *testing.T) {
+		g := NewWithT(t)
+		expectGeneratorItems(g, `
+range:
+  start: ${9223372036854775800}
+  end: ${9223372036854775807}
+  step: 5
+`, &Evaluator{}, Equal([]interface{}{
+			int64(9223372036854775800), int64(9223372036854775805),
+		}))
+		expectGeneratorItems(g, `
+range:
+  start: ${-9223372036854775800}
+  end: ${-9223372036854775807 - 1}
+  step: -5
+`, &Evaluator{}, Equal([]interface{}{
+			int64(-9223372036854775800), int64(-9223372036854775805),
+		}))
+	})
+
+	t.Run("refuses an unsigned bound that's too big", func(t *testing.T) {
+		g := NewWithT(t)
+		expectGeneratorError(g, `
+range:
+  end: ${18446744073709551615u}
+`, &Evaluator{})
+	})
+}
+
 var count int
 
 func newNamespaceAndEval(g Gomega) (string, *Evaluator) {
@@ -79,8 +210,7 @@ func newNamespaceAndEval(g Gomega) (string, *Evaluator) {
 	ns.Name = namespace
 	g.Expect(k8sClient.Create(context.TODO(), &ns)).To(Succeed())
 
-	k8s := client.NewNamespacedClient(k8sClient, namespace)
-	ev := &Evaluator{Client: k8s}
+	ev := &Evaluator{Client: k8sClient, Namespace: namespace}
 
 	return namespace, ev
 }
@@ -126,27 +256,261 @@ query:
 			expectGeneratorItems(g, namedObject, ev, ConsistOf(matchKeys(obj)))
 		})
 	})
-}
 
-func Test_request(t *testing.T) {
-	t.Run("there's a request generator", func(t *testing.T) {
+	t.Run("there's a query generator using selectors", func(t *testing.T) {
+		createConfigMaps := func(g *WithT, namespace string) {
+			for _, name := range []string{"foo", "bar", "baz"} {
+				var cm corev1.ConfigMap
+				cm.Name = name
+				cm.Namespace = namespace
+				cm.Labels = map[string]string{"app": name}
+				if name != "baz" {
+					cm.Labels["tier"] = "backend"
+				}
+				g.Expect(k8sClient.Create(context.TODO(), &cm)).To(Succeed())
+			}
+		}
+		hasName := func(name string) types.GomegaMatcher {
+			return matchKeys(map[string]interface{}{
+				"metadata": map[string]interface{}{"name": name},
+			})
+		}
+
+		t.Run("with interpolated matchLabels", func(t *testing.T) {
+			g := NewWithT(t)
+			namespace, ev := newNamespaceAndEval(g)
+			createConfigMaps(g, namespace)
+			const query = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  matchLabels:
+    app: ${"f" + "oo"}
+`
+			expectGeneratorItems(g, query, ev, ConsistOf(hasName("foo")))
+		})
+
+		t.Run("with matchExpressions", func(t *testing.T) {
+			g := NewWithT(t)
+			namespace, ev := newNamespaceAndEval(g)
+			createConfigMaps(g, namespace)
+			const query = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  matchExpressions:
+  - key: tier
+    operator: Exists
+  - key: app
+    operator: NotIn
+    values:
+    - ${"foo"}
+`
+			expectGeneratorItems(g, query, ev, ConsistOf(hasName("bar")))
+		})
+
+		t.Run("with a field selector", func(t *testing.T) {
+			g := NewWithT(t)
+			namespace, ev := newNamespaceAndEval(g)
+			createConfigMaps(g, namespace)
+			const query = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  fieldSelector: metadata.name=${"baz"}
+`
+			expectGeneratorItems(g, query, ev, ConsistOf(hasName("baz")))
+		})
+	})
+
+	t.Run("there's a query generator to be watched", func(t *testing.T) {
 		g := NewWithT(t)
-		var requestGenerator = `
-request:
-  url: ` + baseurl + `/flux-whatif-pulls.json
-`
-		// The returned item is itself a list, hence the nested
-		// ConsistOf -- saying "the result is a list, consisting of an
-		// element which is a list consisting of ...".
-		expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(ConsistOf(
-			matchKeys(map[string]interface{}{
-				"url": "https://api.github.com/repos/squaremo/flux-whatif-example/pulls/1",
-				"head": map[string]interface{}{
-					"ref": "nodeport",
-					"sha": "aa1aed98a09a43f3bb20854fe9de5039f7a9a473",
-				},
-			}),
-		)))
+		namespace, ev := newNamespaceAndEval(g)
+		var spec generate.ComprehensionSpec
+		g.Expect(yaml.Unmarshal([]byte(`
+for:
+- var: name
+  in:
+    list: [foo, bar]
+- var: cm
+  in:
+    query:
+      apiVersion: v1
+      kind: ConfigMap
+      name: ${name}
+- var: secrets
+  in:
+    query:
+      apiVersion: v1
+      kind: Secret
+      matchLabels:
+        app: foo
+yield:
+  template: {}
+`), &spec)).To(Succeed())
+		_, err := ev.Eval(&spec)
+		g.Expect(err).To(HaveOccurred()) // the configmaps don't exist
+
+		// the missing configmap is recorded, since it may yet appear
+		configMapGVK := corev1.SchemeGroupVersion.WithKind("ConfigMap")
+		g.Expect(ev.Queries()).To(ConsistOf(
+			Query{GVK: configMapGVK, Namespace: namespace, Name: "foo"},
+		))
+
+		for _, name := range []string{"foo", "bar"} {
+			var cm corev1.ConfigMap
+			cm.Name = name
+			cm.Namespace = namespace
+			g.Expect(k8sClient.Create(context.TODO(), &cm)).To(Succeed())
+		}
+		_, err = ev.Eval(&spec)
+		g.Expect(err).NotTo(HaveOccurred())
+		g.Expect(ev.Queries()).To(ContainElements(
+			Query{GVK: configMapGVK, Namespace: namespace, Name: "foo"},
+			Query{GVK: configMapGVK, Namespace: namespace, Name: "bar"},
+			HaveField("GVK", corev1.SchemeGroupVersion.WithKind("Secret")),
+		))
+	})
+
+	t.Run("there's a query generator selecting many objects", func(t *testing.T) {
+		defer func(n int) { listPageSize = n }(listPageSize)
+		listPageSize = 2
+
+		g := NewWithT(t)
+		namespace, ev := newNamespaceAndEval(g)
+		for i := 0; i < 5; i++ {
+			var cm corev1.ConfigMap
+			cm.Name = fmt.Sprintf("cm-%d", i)
+			cm.Namespace = namespace
+			cm.Labels = map[string]string{"app": "many"}
+			g.Expect(k8sClient.Create(context.TODO(), &cm)).To(Succeed())
+		}
+
+		t.Run("lists them all, in chunks", func(t *testing.T) {
+			g := NewWithT(t)
+			const query = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  matchLabels:
+    app: many
+`
+			expectGeneratorItems(g, query, ev, HaveLen(5))
+		})
+
+		t.Run("yields no more than the limit", func(t *testing.T) {
+			g := NewWithT(t)
+			const query = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  matchLabels:
+    app: many
+  limit: 3
+`
+			expectGeneratorItems(g, query, ev, HaveLen(3))
+		})
+	})
+
+	t.Run("there's a query generator looking in other namespaces", func(t *testing.T) {
+		createConfigMap := func(g *WithT, namespace string) map[string]interface{} {
+			var cm unstructured.Unstructured
+			cm.SetAPIVersion("v1")
+			cm.SetKind("ConfigMap")
+			cm.SetName("test")
+			cm.SetNamespace(namespace)
+			cm.SetLabels(map[string]string{"cross-namespace-test": "true"})
+			g.Expect(k8sClient.Create(context.TODO(), &cm)).To(Succeed())
+			return cm.Object
+		}
+		labelNamespace := func(g *WithT, namespace string) {
+			var ns corev1.Namespace
+			g.Expect(k8sClient.Get(context.TODO(), client.ObjectKey{Name: namespace}, &ns)).To(Succeed())
+			ns.Labels = map[string]string{"cross-namespace-test": "true"}
+			g.Expect(k8sClient.Update(context.TODO(), &ns)).To(Succeed())
+		}
+
+		t.Run("is refused unless allowed", func(t *testing.T) {
+			g := NewWithT(t)
+			const otherNamespace = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  name: test
+  namespace: ${"other"}
+`
+			expectGeneratorError(g, otherNamespace, &Evaluator{Namespace: "mine"})
+
+			const namespaceSelector = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  name: test
+  namespaceSelector: {}
+`
+			expectGeneratorError(g, namespaceSelector, &Evaluator{Namespace: "mine"})
+		})
+
+		t.Run("uses the namespace given", func(t *testing.T) {
+			g := NewWithT(t)
+			other, _ := newNamespaceAndEval(g)
+			obj := createConfigMap(g, other)
+			_, ev := newNamespaceAndEval(g)
+			ev.AllowCrossNamespace = true
+
+			var query = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  name: test
+  namespace: ` + other + `
+`
+			expectGeneratorItems(g, query, ev, ConsistOf(matchKeys(obj)))
+		})
+
+		t.Run("gets the named object from each namespace selected", func(t *testing.T) {
+			g := NewWithT(t)
+			ns1, _ := newNamespaceAndEval(g)
+			ns2, _ := newNamespaceAndEval(g)
+			ns3, ev := newNamespaceAndEval(g)
+			ev.AllowCrossNamespace = true
+			labelNamespace(g, ns1)
+			labelNamespace(g, ns2)
+			obj1 := createConfigMap(g, ns1)
+			createConfigMap(g, ns3) // not selected
+
+			const query = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  name: test
+  namespaceSelector:
+    matchLabels:
+      cross-namespace-test: "true"
+`
+			// ns2 is selected, but has no such object.
+			expectGeneratorItems(g, query, ev, ConsistOf(matchKeys(obj1)))
+		})
+
+		t.Run("lists objects in all namespaces", func(t *testing.T) {
+			g := NewWithT(t)
+			ns1, _ := newNamespaceAndEval(g)
+			ns2, ev := newNamespaceAndEval(g)
+			ev.AllowCrossNamespace = true
+			obj1 := createConfigMap(g, ns1)
+			obj2 := createConfigMap(g, ns2)
+
+			const query = `
+query:
+  apiVersion: v1
+  kind: ConfigMap
+  matchLabels:
+    cross-namespace-test: "true"
+  namespaceSelector: {}
+`
+			// other tests may have created objects with the label too
+			expectGeneratorItems(g, query, ev, ContainElements(matchKeys(obj1), matchKeys(obj2)))
+		})
 	})
 }
 
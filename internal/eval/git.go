@@ -0,0 +1,429 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+	corev1 "k8s.io/api/core/v1"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+// == git
+
+func compileGit(e *env, expr *generate.Generator) (eagerGeneratorFunc, error) {
+	repo := expr.Git.DeepCopy()
+	if (len(repo.Directories) == 0) == (len(repo.Files) == 0) {
+		return nil, fmt.Errorf("git generator must specify exactly one of .directories and .files")
+	}
+	for _, pattern := range append(repo.Directories, repo.Files...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	ce, err := e.celEnv()
+	if err != nil {
+		return nil, err
+	}
+	var evals []evaluationFunc
+	urlEval, err := compileString(ce, repo.URL, replaceStrPointer(&repo.URL))
+	if err != nil {
+		return nil, err
+	}
+	if urlEval != nil {
+		evals = append(evals, urlEval)
+	}
+	refEval, err := compileString(ce, repo.Ref, replaceStrPointer(&repo.Ref))
+	if err != nil {
+		return nil, err
+	}
+	if refEval != nil {
+		evals = append(evals, refEval)
+	}
+
+	return func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error) {
+		for i := range evals {
+			if err := evals[i](ar); err != nil {
+				return nil, err
+			}
+		}
+		return ev.generateGit(repo)
+	}, nil
+}
+
+func (ev *Evaluator) generateGit(repo *generate.GitRepository) ([]interface{}, error) {
+	tree, err := ev.fetchTree(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []interface{}
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("cannot read git tree: %w", err)
+		}
+
+		switch {
+		case entry.Mode == filemode.Dir && matchAny(repo.Directories, name):
+			result = append(result, map[string]interface{}{
+				"path": name,
+				"name": path.Base(name),
+			})
+		case entry.Mode.IsFile() && matchAny(repo.Files, name):
+			values, err := decodeGitFile(tree, name, repo.Format)
+			if err != nil {
+				return nil, err
+			}
+			for i := range values {
+				result = append(result, map[string]interface{}{
+					"path":    name,
+					"name":    path.Base(name),
+					"content": values[i],
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// formatFromExtension guesses the format of a file from its name, or
+// returns "" if it can't.
+func formatFromExtension(name string) string {
+	switch path.Ext(name) {
+	case ".json":
+		return formatJSON
+	case ".ndjson", ".jsonl":
+		return formatNDJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".csv":
+		return formatCSV
+	default:
+		return ""
+	}
+}
+
+func decodeGitFile(tree *object.Tree, name, format string) ([]interface{}, error) {
+	file, err := tree.File(name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s from git tree: %w", name, err)
+	}
+	r, err := file.Reader()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s from git tree: %w", name, err)
+	}
+	defer r.Close()
+	return decodeFile(name, format, r)
+}
+
+// decodeFile decodes the content of a file according to the format,
+// or according to its extension if no format is given. If the format
+// can't be guessed, the content is given as a string.
+func decodeFile(name, format string, r io.Reader) ([]interface{}, error) {
+	if format == "" {
+		format = formatFromExtension(name)
+	}
+	if format == "" {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", name, err)
+		}
+		return []interface{}{string(content)}, nil
+	}
+	values, err := decodeResponse(format, r, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %w", name, err)
+	}
+	return values, nil
+}
+
+// gitTimeout is the longest a git repository can take to fetch.
+const gitTimeout = 2 * time.Minute
+
+// fetchTree fetches the tree at the ref given in the repository, or
+// reuses the tree fetched earlier in the evaluation.
+func (ev *Evaluator) fetchTree(repo *generate.GitRepository) (*object.Tree, error) {
+	key := repo.URL + "\x00" + repo.Ref
+	if repo.Auth != nil {
+		key += "\x00" + repo.Auth.SecretRef.Name
+	}
+	if tree, ok := ev.trees[key]; ok {
+		return tree, nil
+	}
+
+	repoURL, err := url.Parse(repo.URL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse git repository URL: %w", err)
+	}
+	// Other transports would let anyone read the controller's
+	// filesystem (file://, or a path), or get around the egress
+	// policy (ssh://, git://). Local repositories are allowed only
+	// when the evaluator says so; e.g., when running on someone's
+	// own machine.
+	local := repoURL.Scheme == "file" && ev.AllowLocalRepositories
+	if repoURL.Scheme != "https" && repoURL.Scheme != "http" && !local {
+		return nil, fmt.Errorf("git repository URL has unsupported scheme %q; only http and https are supported", repoURL.Scheme)
+	}
+	if err := ev.Egress.checkURL(repoURL); err != nil && !local {
+		return nil, err
+	}
+
+	var auth *githttp.BasicAuth
+	if repo.Auth != nil && !local {
+		if auth, err = ev.gitAuth(repo.Auth); err != nil {
+			return nil, err
+		}
+	}
+
+	installGitTransport.Do(func() {
+		transport := githttp.NewClient(gitHTTPClient)
+		client.InstallProtocol("http", transport)
+		client.InstallProtocol("https", transport)
+	})
+	fetch := &gitFetch{egress: ev.Egress, url: repo.URL, maxSize: ev.maxDownloadSize()}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.TODO(), gitFetchKey{}, fetch), gitTimeout)
+	defer cancel()
+
+	tree, err := fetchTreeContext(ctx, repo.URL, repo.Ref, auth)
+	if fetch.exceeded() {
+		return nil, &LimitError{URL: repo.URL, What: "git repository", Limit: fetch.maxSize}
+	}
+	if err != nil {
+		var egressErr *EgressError
+		if errors.As(err, &egressErr) {
+			return nil, egressErr
+		}
+		return nil, err
+	}
+
+	if ev.trees == nil {
+		ev.trees = map[string]*object.Tree{}
+	}
+	ev.trees[key] = tree
+	return tree, nil
+}
+
+func fetchTreeContext(ctx context.Context, repoURL, ref string, auth *githttp.BasicAuth) (*object.Tree, error) {
+	// Only the commit at the ref is needed, so clone just that, if it
+	// names a branch or tag. A commit can't be asked for by itself,
+	// so in that case the history is fetched, but still not the tags.
+	opts := &git.CloneOptions{
+		URL:          repoURL,
+		Depth:        1,
+		SingleBranch: true,
+		Tags:         git.NoTags,
+	}
+	if auth != nil {
+		opts.Auth = auth
+	}
+	var commitRef bool
+	if ref != "" {
+		remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+			Name: git.DefaultRemoteName,
+			URLs: []string{repoURL},
+		})
+		refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: opts.Auth})
+		if err != nil {
+			return nil, fmt.Errorf("cannot list refs of git repository: %w", err)
+		}
+		switch name := findRef(refs, ref); {
+		case name != "":
+			opts.ReferenceName = name
+		case plumbing.IsHash(ref):
+			opts.Depth, opts.SingleBranch = 0, false
+			commitRef = true
+		default:
+			return nil, fmt.Errorf("ref %q not found in git repository", ref)
+		}
+	}
+
+	r, err := git.CloneContext(ctx, memory.NewStorage(), nil, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch git repository: %w", err)
+	}
+	var hash plumbing.Hash
+	if commitRef {
+		hash = plumbing.NewHash(ref)
+	} else {
+		head, err := r.Head()
+		if err != nil {
+			return nil, fmt.Errorf("cannot find HEAD of git repository: %w", err)
+		}
+		hash = head.Hash()
+	}
+	commit, err := r.CommitObject(hash)
+	if err != nil {
+		// HEAD may be an annotated tag, rather than a commit.
+		tag, tagErr := r.TagObject(hash)
+		if tagErr != nil {
+			return nil, fmt.Errorf("cannot get commit %s: %w", hash, err)
+		}
+		if commit, err = tag.Commit(); err != nil {
+			return nil, fmt.Errorf("cannot get commit for tag %s: %w", tag.Name, err)
+		}
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("cannot get tree of commit %s: %w", commit.Hash, err)
+	}
+	return tree, nil
+}
+
+// findRef looks for a ref given as a full name (e.g.,
+// `refs/heads/main`), or as the short name of a branch or tag, among
+// the refs of a repository.
+func findRef(refs []*plumbing.Reference, ref string) plumbing.ReferenceName {
+	for _, name := range []plumbing.ReferenceName{
+		plumbing.ReferenceName(ref),
+		plumbing.NewBranchReferenceName(ref),
+		plumbing.NewTagReferenceName(ref),
+	} {
+		for i := range refs {
+			if refs[i].Name() == name {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// go-git's transports are registered globally, so rather than making
+// a client for each fetch, one client is installed for HTTP(S), and
+// it gets the egress policy and size limit for each request from its
+// context.
+var installGitTransport sync.Once
+
+type gitFetchKey struct{}
+
+// gitFetch holds what applies to the HTTP requests of a git fetch.
+type gitFetch struct {
+	egress  *EgressPolicy
+	url     string
+	maxSize int64
+	read    int64
+}
+
+func (f *gitFetch) exceeded() bool {
+	return f.maxSize > 0 && atomic.LoadInt64(&f.read) > f.maxSize
+}
+
+func gitFetchFrom(ctx context.Context) *gitFetch {
+	fetch, _ := ctx.Value(gitFetchKey{}).(*gitFetch)
+	return fetch
+}
+
+var gitHTTPClient = &http.Client{
+	Transport: gitTransport{},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if fetch := gitFetchFrom(req.Context()); fetch != nil {
+			return fetch.egress.checkRedirect(req, via)
+		}
+		if len(via) >= maxRedirects {
+			return errors.New("stopped after too many redirects")
+		}
+		return nil
+	},
+}
+
+// gitTransport makes requests with the transport that follows the
+// egress policy, and counts the bytes read against the size limit.
+type gitTransport struct{}
+
+func (gitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fetch := gitFetchFrom(req.Context())
+	if fetch == nil {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	transport := http.DefaultTransport
+	if fetch.egress != nil {
+		transport = fetch.egress.sharedClient().Transport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, fetch: fetch}
+	return resp, nil
+}
+
+type countingBody struct {
+	io.ReadCloser
+	fetch *gitFetch
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.fetch.read, int64(n))
+	if b.fetch.exceeded() {
+		return n, &LimitError{URL: b.fetch.url, What: "git repository", Limit: b.fetch.maxSize}
+	}
+	return n, err
+}
+
+// gitAuth gets credentials for fetching a git repository from the
+// secret referred to.
+func (ev *Evaluator) gitAuth(auth *generate.RequestAuth) (*githttp.BasicAuth, error) {
+	var secret corev1.Secret
+	if err := ev.getLocalObject(auth.SecretRef.Name, &secret); err != nil {
+		return nil, fmt.Errorf("unable to fetch secret for git auth: %w", err)
+	}
+	username := string(secret.Data["username"])
+	if username == "" {
+		username = "git"
+	}
+	password := secret.Data["password"]
+	if len(password) == 0 {
+		password = secret.Data["bearerToken"]
+	}
+	if len(password) == 0 {
+		return nil, fmt.Errorf("secret %q has neither password nor bearerToken for git auth", auth.SecretRef.Name)
+	}
+	return &githttp.BasicAuth{Username: username, Password: string(password)}, nil
+}
@@ -0,0 +1,306 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"errors"
+	"net/http/cgi"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	. "github.com/onsi/gomega"
+	"sigs.k8s.io/yaml"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+// commitFiles writes the files given into the worktree, and commits
+// them.
+func commitFiles(g Gomega, wt *git.Worktree, files map[string]string) {
+	for name, content := range files {
+		fullpath := filepath.Join(wt.Filesystem.Root(), name)
+		g.Expect(os.MkdirAll(filepath.Dir(fullpath), 0755)).To(Succeed())
+		g.Expect(os.WriteFile(fullpath, []byte(content), 0644)).To(Succeed())
+		_, err := wt.Add(name)
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	_, err := wt.Commit("commit files", &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com", When: time.Now()},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+}
+
+// newGitRepo makes a repository with a commit on main, tagged `v1`,
+// and another commit on the branch `next`.
+func newGitRepo(g Gomega, dir string) {
+	repo, err := git.PlainInitWithOptions(dir, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.NewBranchReferenceName("main")},
+	})
+	g.Expect(err).NotTo(HaveOccurred())
+	wt, err := repo.Worktree()
+	g.Expect(err).NotTo(HaveOccurred())
+
+	commitFiles(g, wt, map[string]string{
+		"apps/foo/config.yaml": "name: foo\nreplicas: 1\n",
+		"apps/bar/config.yaml": "name: bar\nreplicas: 2\n",
+		"apps/README":          "Applications\n",
+		"clusters/list.json":   `[{"name": "dev"}, {"name": "prod"}]`,
+	})
+	head, err := repo.Head()
+	g.Expect(err).NotTo(HaveOccurred())
+	_, err = repo.CreateTag("v1", head.Hash(), nil)
+	g.Expect(err).NotTo(HaveOccurred())
+
+	g.Expect(wt.Checkout(&git.CheckoutOptions{
+		Branch: plumbing.NewBranchReferenceName("next"),
+		Create: true,
+	})).To(Succeed())
+	commitFiles(g, wt, map[string]string{
+		"apps/baz/config.yaml": "name: baz\nreplicas: 3\n",
+	})
+	g.Expect(wt.Checkout(&git.CheckoutOptions{
+		Branch: plumbing.NewBranchReferenceName("main"),
+	})).To(Succeed())
+}
+
+// serveGitRepos serves the repositories in root over HTTP, with git's
+// own HTTP backend. It returns the URL of the server.
+func serveGitRepos(t *testing.T, root string) string {
+	execPath, err := exec.Command("git", "--exec-path").Output()
+	if err != nil {
+		t.Skip("git is not available to serve repositories over HTTP")
+	}
+	backend := filepath.Join(strings.TrimSpace(string(execPath)), "git-http-backend")
+	if _, err := os.Stat(backend); err != nil {
+		t.Skip("git-http-backend is not available")
+	}
+	server := httptest.NewServer(&cgi.Handler{
+		Path: backend,
+		Env:  []string{"GIT_PROJECT_ROOT=" + root, "GIT_HTTP_EXPORT_ALL=1"},
+	})
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func Test_git(t *testing.T) {
+	g := NewWithT(t)
+	root := t.TempDir()
+	repoPath := filepath.Join(root, "repo")
+	newGitRepo(g, repoPath)
+
+	// The generator is tested with a local repository, which needs
+	// nothing else; and over HTTP, if git is there to serve it.
+	transports := []struct {
+		name    string
+		repoURL func(t *testing.T) string
+		newEval func() *Evaluator
+	}{
+		{
+			name:    "file",
+			repoURL: func(*testing.T) string { return "file://" + repoPath },
+			newEval: func() *Evaluator { return &Evaluator{AllowLocalRepositories: true} },
+		},
+		{
+			name:    "http",
+			repoURL: func(t *testing.T) string { return serveGitRepos(t, root) + "/repo" },
+			newEval: func() *Evaluator { return &Evaluator{} },
+		},
+	}
+
+	for _, transport := range transports {
+		transport := transport
+		t.Run("over "+transport.name, func(t *testing.T) {
+			repoURL, newEval := transport.repoURL(t), transport.newEval
+
+			t.Run("generates directories", func(t *testing.T) {
+				g := NewWithT(t)
+				expectGeneratorItems(g, `
+git:
+  url: `+repoURL+`
+  directories: ["apps/*"]
+`, newEval(), ConsistOf(
+					map[string]interface{}{"path": "apps/foo", "name": "foo"},
+					map[string]interface{}{"path": "apps/bar", "name": "bar"},
+				))
+			})
+
+			t.Run("generates decoded files", func(t *testing.T) {
+				g := NewWithT(t)
+				expectGeneratorItems(g, `
+git:
+  url: `+repoURL+`
+  files: ["apps/*/config.yaml", "clusters/*"]
+`, newEval(), ConsistOf(
+					map[string]interface{}{
+						"path":    "apps/foo/config.yaml",
+						"name":    "config.yaml",
+						"content": map[string]interface{}{"name": "foo", "replicas": float64(1)},
+					},
+					map[string]interface{}{
+						"path":    "apps/bar/config.yaml",
+						"name":    "config.yaml",
+						"content": map[string]interface{}{"name": "bar", "replicas": float64(2)},
+					},
+					map[string]interface{}{
+						"path": "clusters/list.json",
+						"name": "list.json",
+						"content": []interface{}{
+							map[string]interface{}{"name": "dev"},
+							map[string]interface{}{"name": "prod"},
+						},
+					},
+				))
+			})
+
+			t.Run("gives unrecognised files as strings", func(t *testing.T) {
+				g := NewWithT(t)
+				expectGeneratorItems(g, `
+git:
+  url: `+repoURL+`
+  files: ["apps/README"]
+`, newEval(), Equal([]interface{}{
+					map[string]interface{}{
+						"path":    "apps/README",
+						"name":    "README",
+						"content": "Applications\n",
+					},
+				}))
+			})
+
+			for _, ref := range []string{"next", "v1"} {
+				ref := ref
+				t.Run("uses ref "+ref, func(t *testing.T) {
+					g := NewWithT(t)
+					expected := []interface{}{"apps/bar", "apps/foo"}
+					if ref == "next" {
+						expected = append(expected, "apps/baz")
+					}
+					expectGeneratorItems(g, `
+git:
+  url: `+repoURL+`
+  ref: `+ref+`
+  directories: ["apps/*"]
+`, newEval(), WithTransform(func(items []interface{}) []interface{} {
+						var paths []interface{}
+						for _, item := range items {
+							paths = append(paths, item.(map[string]interface{})["path"])
+						}
+						return paths
+					}, ConsistOf(expected...)))
+				})
+			}
+
+			t.Run("fails on a missing ref", func(t *testing.T) {
+				g := NewWithT(t)
+				err := expectGeneratorError(g, `
+git:
+  url: `+repoURL+`
+  ref: nonesuch
+  directories: ["*"]
+`, newEval())
+				g.Expect(err.Error()).To(ContainSubstring("nonesuch"))
+			})
+
+			t.Run("uses a commit as ref", func(t *testing.T) {
+				g := NewWithT(t)
+				repo, err := git.PlainOpen(repoPath)
+				g.Expect(err).NotTo(HaveOccurred())
+				next, err := repo.Reference(plumbing.NewBranchReferenceName("next"), false)
+				g.Expect(err).NotTo(HaveOccurred())
+				expectGeneratorItems(g, `
+git:
+  url: `+repoURL+`
+  ref: `+next.Hash().String()+`
+  directories: ["apps/*"]
+`, newEval(), ContainElement(HaveKeyWithValue("path", "apps/baz")))
+			})
+		})
+	}
+
+	t.Run("refuses local repositories unless allowed", func(t *testing.T) {
+		g := NewWithT(t)
+		for _, url := range []string{
+			"file://" + repoPath,
+			repoPath,
+		} {
+			err := expectGeneratorError(g, `
+git:
+  url: `+url+`
+  directories: ["*"]
+`, &Evaluator{})
+			g.Expect(err.Error()).To(ContainSubstring("unsupported scheme"))
+		}
+		// Even when local repositories are allowed, they must be
+		// given as file:// URLs.
+		err := expectGeneratorError(g, `
+git:
+  url: `+repoPath+`
+  directories: ["*"]
+`, &Evaluator{AllowLocalRepositories: true})
+		g.Expect(err.Error()).To(ContainSubstring("unsupported scheme"))
+	})
+
+	t.Run("over http, with restrictions", func(t *testing.T) {
+		repoURL := serveGitRepos(t, root) + "/repo"
+
+		t.Run("follows the egress policy", func(t *testing.T) {
+			g := NewWithT(t)
+			policy, err := NewEgressPolicy(nil, []string{"127.0.0.0/8", "::1/128"})
+			g.Expect(err).NotTo(HaveOccurred())
+			err = expectGeneratorError(g, `
+git:
+  url: `+repoURL+`
+  directories: ["*"]
+`, &Evaluator{Egress: policy})
+			var egressErr *EgressError
+			g.Expect(errors.As(err, &egressErr)).To(BeTrue())
+		})
+
+		t.Run("limits the size of the repository", func(t *testing.T) {
+			g := NewWithT(t)
+			err := expectGeneratorError(g, `
+git:
+  url: `+repoURL+`
+  directories: ["*"]
+`, &Evaluator{MaxBodySize: 64})
+			var limitErr *LimitError
+			g.Expect(errors.As(err, &limitErr)).To(BeTrue())
+		})
+	})
+
+	t.Run("needs exactly one of directories and files", func(t *testing.T) {
+		g := NewWithT(t)
+		repoURL := "https://example.com/repo"
+		for _, y := range []string{
+			"{url: " + repoURL + "}",
+			"{url: " + repoURL + ", directories: ['*'], files: ['*']}",
+		} {
+			var gen generate.Generator
+			g.Expect(yaml.Unmarshal([]byte("git: "+y), &gen)).To(Succeed())
+			_, err := compileGenerator(&env{}, &gen)
+			g.Expect(err).To(HaveOccurred())
+		}
+	})
+}
@@ -22,13 +22,47 @@ import (
 	"strings"
 
 	"github.com/google/cel-go/cel"
+	celtypes "github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	"github.com/google/cel-go/common/types/traits"
 )
 
 // evaluationFunc runs an expression given the variable values.
 type evaluationFunc func(map[string]interface{}) error
 
 // replaceFunc is a func for replacing the value at some site
-type replaceFunc func(v interface{})
+type replaceFunc func(v interface{}) error
+
+// ifKey is the key which, in an object in a template, gives a
+// condition for including the object. If the condition doesn't hold,
+// the object is omitted from its parent object or list; or if it's
+// the whole template, nothing is output. Since only objects can have
+// a condition, other values are made conditional by wrapping them
+// with valueKey.
+const ifKey = "$if"
+
+// valueKey is the key which, in an object in a template, gives a
+// value to put in place of the object; e.g., `{$if: ${cond}, $value:
+// 3}` is replaced with 3 if cond holds, and omitted otherwise. It
+// can't be given with other fields, besides `$if`.
+const valueKey = "$value"
+
+// mergeKey is the key which, in an object in a template, gives an
+// object (or list of objects) whose fields are merged into the object.
+// Fields given explicitly take precedence over merged fields.
+const mergeKey = "$merge"
+
+// spliceKey is the key which, as the only field of an object in a
+// list in a template (besides `$if`), gives a list to splice into the
+// surrounding list in place of the object.
+const spliceKey = "$splice"
+
+// omittedValue is the type of omitted.
+type omittedValue struct{}
+
+// omitted is put in place of a value that is to be left out, e.g.,
+// because of `$if`. It's removed when the template output is copied.
+var omitted = omittedValue{}
 
 // template is the result of compiling a template, which you can use
 // to instantiate the template with evaluate(). It is not at all
@@ -56,7 +90,9 @@ func (e *env) celEnv() (*cel.Env, error) {
 		return nil, err
 	}
 	for e != nil {
-		ce, err = ce.Extend(cel.Variable(e.name, cel.AnyType))
+		// Declaring variables as `dyn` (rather than `any`) means
+		// macros like `.filter(...)` can be used with them.
+		ce, err = ce.Extend(cel.Variable(e.name, cel.DynType))
 		if err != nil {
 			return nil, err
 		}
@@ -67,19 +103,23 @@ func (e *env) celEnv() (*cel.Env, error) {
 
 // Deep copy a value output from a template. These are expected to be
 // JSON-compatible values, so channels, os.File, etc., are not a
-// concern.
+// concern. Omitted values are left out of the copy.
 func deepcopy(in interface{}) interface{} {
 	deepcopySlice := func(in []interface{}) interface{} {
-		out := make([]interface{}, len(in))
+		out := make([]interface{}, 0, len(in))
 		for i := range in {
-			out[i] = deepcopy(in[i])
+			if in[i] != omitted {
+				out = append(out, deepcopy(in[i]))
+			}
 		}
 		return out
 	}
 	deepcopyMap := func(in map[string]interface{}) interface{} {
 		out := map[string]interface{}{}
 		for k, v := range in {
-			out[k] = deepcopy(v)
+			if v != omitted {
+				out[k] = deepcopy(v)
+			}
 		}
 		return out
 	}
@@ -94,8 +134,9 @@ func deepcopy(in interface{}) interface{} {
 }
 
 func replacePointer(site *interface{}) replaceFunc {
-	return func(v interface{}) {
+	return func(v interface{}) error {
 		*site = v
+		return nil
 	}
 }
 
@@ -127,9 +168,9 @@ func compileAny(ce *cel.Env, t interface{}, r replaceFunc) ([]evaluationFunc, er
 		}
 		return nil, nil
 	case map[string]interface{}:
-		return compileMap(ce, obj)
+		return compileMap(ce, obj, r)
 	case []interface{}:
-		return compileSlice(ce, obj)
+		return compileSlice(ce, obj, r)
 	default:
 		//fmt.Printf("Type = %s\n", reflect.TypeOf(t))
 		return nil, nil
@@ -163,8 +204,7 @@ func compileString(ce *cel.Env, template string, rfn replaceFunc) (evaluationFun
 			if err != nil {
 				return err
 			}
-			rfn(ref.Value())
-			return nil
+			return rfn(ref.Value())
 		}
 		return fn, nil
 	}
@@ -207,21 +247,36 @@ func compileString(ce *cel.Env, template string, rfn replaceFunc) (evaluationFun
 				return err
 			}
 		}
-		rfn(strings.Join(out, ""))
-		return nil
+		return rfn(strings.Join(out, ""))
 	}
 	return fn, nil
 }
 
 func replaceMapItem(m map[string]interface{}, k string) replaceFunc {
-	return func(v interface{}) {
+	return func(v interface{}) error {
 		m[k] = v
+		return nil
 	}
 }
 
 // compileMap descends through a map value, and returns any funcs
-// needed to do replacements within.
-func compileMap(ce *cel.Env, t map[string]interface{}) ([]evaluationFunc, error) {
+// needed to do replacements within. If the map has fields to merge
+// in, a new map with those and the fields of the map is put at the
+// replacement site. If the map has a condition, the map is put at the
+// replacement site only if the condition holds. If the map wraps a
+// value, it's the value that's put there rather than the map.
+func compileMap(ce *cel.Env, t map[string]interface{}, r replaceFunc) ([]evaluationFunc, error) {
+	cond, hasCond := t[ifKey]
+	delete(t, ifKey)
+	if value, hasValue := t[valueKey]; hasValue {
+		if len(t) > 1 {
+			return nil, fmt.Errorf("%s cannot be given with fields other than %s", valueKey, ifKey)
+		}
+		return compileWrappedValue(ce, value, cond, hasCond, r)
+	}
+	merge, hasMerge := t[mergeKey]
+	delete(t, mergeKey)
+
 	var replacements []evaluationFunc
 	for k, v := range t {
 		fieldReplacements, err := compileAny(ce, v, replaceMapItem(t, k))
@@ -230,21 +285,243 @@ func compileMap(ce *cel.Env, t map[string]interface{}) ([]evaluationFunc, error)
 		}
 		replacements = append(replacements, fieldReplacements...)
 	}
-	return replacements, nil
+
+	put := func(map[string]interface{}) error {
+		return r(t)
+	}
+	if hasMerge {
+		var err error
+		if put, err = compileMerge(ce, merge, t, r); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case hasCond:
+		return compileIf(ce, cond, replacements, put, r)
+	case hasMerge:
+		return append(replacements, put), nil
+	default:
+		return replacements, nil
+	}
+}
+
+// compileWrappedValue descends through the value given with
+// valueKey, and returns the funcs needed to put it (with replacements
+// done) in place of the object wrapping it, if the condition holds.
+func compileWrappedValue(ce *cel.Env, value, cond interface{}, hasCond bool, r replaceFunc) ([]evaluationFunc, error) {
+	replacements, err := compileAny(ce, value, replacePointer(&value))
+	if err != nil {
+		return nil, err
+	}
+	put := func(map[string]interface{}) error {
+		return r(value)
+	}
+	if hasCond {
+		return compileIf(ce, cond, replacements, put, r)
+	}
+	return append(replacements, put), nil
+}
+
+// compileMerge returns a func which puts, at the replacement site, a
+// map with the fields of the value(s) to merge, overlaid with the
+// fields of the map.
+func compileMerge(ce *cel.Env, merge interface{}, t map[string]interface{}, r replaceFunc) (evaluationFunc, error) {
+	var sources []valueFunc
+	mergeList, ok := merge.([]interface{})
+	if !ok {
+		mergeList = []interface{}{merge}
+	}
+	for _, m := range mergeList {
+		source, err := compileValue(ce, m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", mergeKey, err)
+		}
+		sources = append(sources, source)
+	}
+
+	return func(ar map[string]interface{}) error {
+		out := map[string]interface{}{}
+		for _, source := range sources {
+			val, err := source(ar)
+			if err != nil {
+				return err
+			}
+			switch fields := val.(type) {
+			case nil, omittedValue:
+			case map[string]interface{}:
+				for k, v := range fields {
+					out[k] = v
+				}
+			default:
+				return fmt.Errorf("%s value must be an object, but is a %T", mergeKey, val)
+			}
+		}
+		for k, v := range t {
+			// A field that's omitted doesn't override the merged
+			// field.
+			if v != omitted {
+				out[k] = v
+			}
+		}
+		return r(out)
+	}, nil
+}
+
+// valueFunc gives the value of an expression or a template, given the
+// variable values.
+type valueFunc func(map[string]interface{}) (interface{}, error)
+
+// compileValue compiles a value which is either a single expression,
+// whose result is converted to a plain value, or a template.
+func compileValue(ce *cel.Env, v interface{}) (valueFunc, error) {
+	if s, ok := v.(string); ok {
+		parts, err := parseInterpolation(s)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) == 1 && parts[0].expr != "" {
+			prog, err := compileExpr(ce, parts[0].expr)
+			if err != nil {
+				return nil, err
+			}
+			return func(ar map[string]interface{}) (interface{}, error) {
+				ref, _, err := prog.Eval(ar)
+				if err != nil {
+					return nil, err
+				}
+				return nativeValue(ref)
+			}, nil
+		}
+	}
+
+	value := v
+	replacements, err := compileAny(ce, v, replacePointer(&value))
+	if err != nil {
+		return nil, err
+	}
+	return func(ar map[string]interface{}) (interface{}, error) {
+		for i := range replacements {
+			if err := replacements[i](ar); err != nil {
+				return nil, err
+			}
+		}
+		return deepcopy(value), nil
+	}, nil
+}
+
+// compileIf returns the func for a value with a condition: if the
+// condition holds, the replacements within the value are done and
+// put() is called; otherwise, the value is
+// omitted, and the replacements (which may rely on the condition
+// holding) are not done.
+func compileIf(ce *cel.Env, cond interface{}, replacements []evaluationFunc, put evaluationFunc, r replaceFunc) ([]evaluationFunc, error) {
+	var holds func(map[string]interface{}) (bool, error)
+	switch c := cond.(type) {
+	case bool:
+		holds = func(map[string]interface{}) (bool, error) {
+			return c, nil
+		}
+	case string:
+		parts, err := parseInterpolation(c)
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 1 || parts[0].expr == "" {
+			return nil, fmt.Errorf("%s must be a boolean or a single expression, e.g., ${x == y}", ifKey)
+		}
+		prog, err := compileExpr(ce, parts[0].expr)
+		if err != nil {
+			return nil, err
+		}
+		holds = func(ar map[string]interface{}) (bool, error) {
+			ref, _, err := prog.Eval(ar)
+			if err != nil {
+				return false, err
+			}
+			return truthy(ref.Value()), nil
+		}
+	default:
+		return nil, fmt.Errorf("%s must be a boolean or a single expression, e.g., ${x == y}", ifKey)
+	}
+
+	fn := func(ar map[string]interface{}) error {
+		ok, err := holds(ar)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return r(omitted)
+		}
+		for i := range replacements {
+			if err := replacements[i](ar); err != nil {
+				return err
+			}
+		}
+		return put(ar)
+	}
+	return []evaluationFunc{fn}, nil
 }
 
 // compileSlice descends through a slice value, returning any funcs
-// needed to do replacements within.
-func compileSlice(ce *cel.Env, t []interface{}) ([]evaluationFunc, error) {
+// needed to do replacements within. If any items are to be spliced,
+// a new slice with the spliced items in place is put at the
+// replacement site.
+func compileSlice(ce *cel.Env, t []interface{}, r replaceFunc) ([]evaluationFunc, error) {
 	var replacements []evaluationFunc
+	splices := map[int]valueFunc{}
 	for i := range t {
+		if m, ok := t[i].(map[string]interface{}); ok && m[spliceKey] != nil {
+			cond, hasCond := m[ifKey]
+			if len(m) > 2 || (len(m) == 2 && !hasCond) {
+				return nil, fmt.Errorf("%s cannot be given with fields other than %s", spliceKey, ifKey)
+			}
+			value := m[spliceKey]
+			if hasCond {
+				// This is omitted when the condition doesn't hold,
+				// and so splices nothing.
+				value = map[string]interface{}{ifKey: cond, valueKey: value}
+			}
+			splice, err := compileValue(ce, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", spliceKey, err)
+			}
+			splices[i] = splice
+			continue
+		}
 		itemReplacements, err := compileAny(ce, t[i], replacePointer(&t[i]))
 		if err != nil {
 			return nil, err
 		}
 		replacements = append(replacements, itemReplacements...)
 	}
-	return replacements, nil
+	if len(splices) == 0 {
+		return replacements, nil
+	}
+
+	put := func(ar map[string]interface{}) error {
+		out := make([]interface{}, 0, len(t))
+		for i := range t {
+			splice, ok := splices[i]
+			if !ok {
+				out = append(out, t[i])
+				continue
+			}
+			val, err := splice(ar)
+			if err != nil {
+				return err
+			}
+			switch items := val.(type) {
+			case nil, omittedValue:
+			case []interface{}:
+				out = append(out, items...)
+			default:
+				return fmt.Errorf("%s value must be a list, but is a %T", spliceKey, val)
+			}
+		}
+		return r(out)
+	}
+	return append(replacements, put), nil
 }
 
 func compileExpr(ce *cel.Env, expr string) (cel.Program, error) {
@@ -259,6 +536,46 @@ func compileExpr(ce *cel.Env, expr string) (cel.Program, error) {
 	return prog, nil
 }
 
+// nativeValue converts the result of evaluating a CEL expression into
+// a plain value, of the kind that you'd get from decoding JSON --
+// apart from numbers, which may also be int64 or uint64. This is
+// needed because lists and maps constructed in CEL (e.g., with
+// `.filter(...)`) have CEL values as their elements, rather than
+// plain values.
+func nativeValue(v ref.Val) (interface{}, error) {
+	switch val := v.(type) {
+	case traits.Lister:
+		out := []interface{}{}
+		for it := val.Iterator(); it.HasNext() == celtypes.True; {
+			item, err := nativeValue(it.Next())
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, item)
+		}
+		return out, nil
+	case traits.Mapper:
+		out := map[string]interface{}{}
+		for it := val.Iterator(); it.HasNext() == celtypes.True; {
+			k := it.Next()
+			key, ok := k.Value().(string)
+			if !ok {
+				return nil, fmt.Errorf("map has non-string key %v", k.Value())
+			}
+			item, err := nativeValue(val.Get(k))
+			if err != nil {
+				return nil, err
+			}
+			out[key] = item
+		}
+		return out, nil
+	}
+	if v.Type() == celtypes.NullType {
+		return nil, nil
+	}
+	return v.Value(), nil
+}
+
 // ----
 // Parsing interpolations (where there could be an expression in the
 // middle of bits of literal string).
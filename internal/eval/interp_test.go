@@ -202,3 +202,166 @@ foo: ${v}
 	// {"foo":"bar"}
 	// {"foo":5}
 }
+
+// demonstrates that `$if` omits a field, or an item of a list, when
+// its condition is false; and that expressions within aren't
+// evaluated when it's omitted.
+func Example_interpolateTemplate_if() {
+	t := `
+spec:
+  rules:
+  - host: ${v.name}.example.com
+  - $if: ${has(v.alias)}
+    host: ${v.alias}.example.com
+  tls:
+    $if: ${v.env == "prod"}
+    secretName: ${v.name}-tls
+`
+	e := &env{name: "v"}
+	templ := compileFromYAML(e, t)
+	for _, v := range []map[string]interface{}{
+		{"name": "shop", "env": "prod", "alias": "store"},
+		{"name": "blog", "env": "dev"},
+		{"name": "docs", "env": "prod"},
+	} {
+		out, err := templ.evaluate(map[string]interface{}{"v": v})
+		if err != nil {
+			panic(err)
+		}
+		printAsJSON(out)
+	}
+	// Output:
+	// {"spec":{"rules":[{"host":"shop.example.com"},{"host":"store.example.com"}],"tls":{"secretName":"shop-tls"}}}
+	// {"spec":{"rules":[{"host":"blog.example.com"}]}}
+	// {"spec":{"rules":[{"host":"docs.example.com"}],"tls":{"secretName":"docs-tls"}}}
+}
+
+// demonstrates merging the fields of an object into an object in the
+// template, with the fields given in the template taking precedence.
+func Example_interpolateTemplate_merge() {
+	t := `
+metadata:
+  labels:
+    $merge: ${v.labels}
+    app: ${v.name}
+    tier: frontend
+`
+	printTemplate(t, "v", map[string]interface{}{
+		"name":   "shop",
+		"labels": map[string]interface{}{"team": "retail", "tier": "backend"},
+	})
+	// Output:
+	// {"metadata":{"labels":{"app":"shop","team":"retail","tier":"frontend"}}}
+}
+
+// demonstrates merging several objects, in order.
+func Example_interpolateTemplate_merge_list() {
+	t := `
+$merge:
+- ${v}
+- {b: 2, c: 2}
+- c: ${v.a + 2}
+a: 0
+`
+	printTemplate(t, "v", map[string]interface{}{"a": 1, "b": 1})
+	// Output:
+	// {"a":0,"b":2,"c":3}
+}
+
+// demonstrates splicing a list into the surrounding list.
+func Example_interpolateTemplate_splice() {
+	t := `
+args:
+- --verbose
+- $splice: ${v}
+- --
+- $splice: ${v.map(x, x + "!")}
+`
+	printTemplate(t, "v", []interface{}{"a", "b"})
+	// Output:
+	// {"args":["--verbose","a","b","--","a!","b!"]}
+}
+
+// demonstrates that $merge and $if work together.
+func Example_interpolateTemplate_merge_if() {
+	t := `
+- $if: ${v != null}
+  $merge: ${v}
+  extra: true
+`
+	printTemplate(t, "v", map[string]interface{}{"a": 1})
+	printTemplate(t, "v", nil)
+	// Output:
+	// [{"a":1,"extra":true}]
+	// []
+}
+
+// demonstrates that an object to merge can have its own $if, as can
+// an item of a list to splice; if the condition is false, nothing is
+// merged or spliced.
+func Example_interpolateTemplate_if_in_merge() {
+	t := `
+$merge:
+- $if: ${v.tls}
+  tls: {secretName: cert}
+- $if: ${!v.tls}
+  insecure: true
+ports:
+- 80
+- $splice:
+  - $if: ${v.tls}
+    port: 443
+`
+	printTemplate(t, "v", map[string]interface{}{"tls": true})
+	printTemplate(t, "v", map[string]interface{}{"tls": false})
+	// Output:
+	// {"ports":[80,{"port":443}],"tls":{"secretName":"cert"}}
+	// {"insecure":true,"ports":[80]}
+}
+
+// demonstrates that a value which isn't an object can be made
+// conditional by wrapping it with $value.
+func Example_interpolateTemplate_if_value() {
+	t := `
+replicas:
+  $if: ${has(v.replicas)}
+  $value: ${v.replicas}
+args:
+- --name=${v.name}
+- $if: ${has(v.replicas)}
+  $value: --scaled
+`
+	printTemplate(t, "v", map[string]interface{}{"name": "shop", "replicas": 3})
+	printTemplate(t, "v", map[string]interface{}{"name": "blog"})
+	// Output:
+	// {"args":["--name=shop","--scaled"],"replicas":3}
+	// {"args":["--name=blog"]}
+}
+
+// demonstrates that a splice can have a condition.
+func Example_interpolateTemplate_splice_if() {
+	t := `
+- 1
+- $if: ${size(v) > 1}
+  $splice: ${v}
+`
+	printTemplate(t, "v", []interface{}{7, 8})
+	printTemplate(t, "v", []interface{}{7})
+	// Output:
+	// [1,7,8]
+	// [1]
+}
+
+// demonstrates that a field omitted with $if doesn't override the
+// field merged in.
+func Example_interpolateTemplate_merge_omitted_field() {
+	t := `
+$merge: ${v}
+a:
+  $if: ${false}
+  b: 1
+`
+	printTemplate(t, "v", map[string]interface{}{"a": 5, "c": 6})
+	// Output:
+	// {"a":5,"c":6}
+}
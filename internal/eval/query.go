@@ -0,0 +1,131 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Query records a query made during evaluation, so that whoever is
+// evaluating can watch for changes that would give a different
+// result.
+type Query struct {
+	GVK schema.GroupVersionKind
+	// Namespace is the namespace queried, or "" for all namespaces.
+	Namespace string
+	// Name is the name of the object, if a single object was
+	// fetched.
+	Name string
+	// Selector is the label selector used to list objects; or nil, if
+	// a single object was fetched. Field selectors aren't recorded, so
+	// a query is taken to match any object its label selector
+	// matches.
+	Selector labels.Selector
+}
+
+// Matches says whether a change to the object given could change the
+// result of the query.
+func (q Query) Matches(obj client.Object) bool {
+	if obj.GetObjectKind().GroupVersionKind() != q.GVK {
+		return false
+	}
+	// A cluster-scoped object has no namespace, and may have been
+	// queried "in" the namespace of the comprehension.
+	if q.Namespace != "" && obj.GetNamespace() != "" && obj.GetNamespace() != q.Namespace {
+		return false
+	}
+	if q.Name != "" {
+		return obj.GetName() == q.Name
+	}
+	return q.Selector == nil || q.Selector.Matches(labels.Set(obj.GetLabels()))
+}
+
+// Queries gives the queries made in the most recent evaluation.
+func (ev *Evaluator) Queries() []Query {
+	return ev.queries
+}
+
+func (ev *Evaluator) recordQuery(q Query) {
+	ev.queries = append(ev.queries, q)
+}
+
+// readerFor gives the reader to use for a query. A cache can't answer
+// queries using field selectors (without an index for each field), so
+// those are always read from the API server. Secrets are read from
+// the API server too, since caching them would mean keeping every
+// Secret in the cluster in memory.
+func (ev *Evaluator) readerFor(gvk schema.GroupVersionKind, fieldSelector string) (reader client.Reader, cached bool) {
+	if ev.CacheReader != nil && fieldSelector == "" && gvk != secretGVK {
+		return ev.CacheReader, true
+	}
+	return ev.Client, false
+}
+
+var secretGVK = corev1.SchemeGroupVersion.WithKind("Secret")
+
+// readTimeout is the longest a read from the API server or the cache
+// can take. Reading a kind from the cache for the first time waits for
+// it to be listed and watched, which will never happen if the
+// controller isn't permitted to do so; this stops that from holding
+// up the evaluation forever.
+var readTimeout = 10 * time.Second
+
+// readContext gives a context for reading objects, which times out
+// after readTimeout.
+func readContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.TODO(), readTimeout)
+}
+
+// readError explains a read that timed out, and otherwise gives the
+// error as it is.
+func readError(err error) error {
+	if apierrors.IsTimeout(err) || errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out reading objects, possibly because the controller is not permitted to list and watch them: %w", err)
+	}
+	return err
+}
+
+// getQueried gets an object by name from the namespace of the
+// evaluation, and records the query. The query is recorded if the
+// object is missing, too, so that whoever is evaluating can try again
+// once it exists.
+func (ev *Evaluator) getQueried(gvk schema.GroupVersionKind, name string, obj client.Object) error {
+	reader, _ := ev.readerFor(gvk, "")
+	if reader == nil {
+		return fmt.Errorf("there is no client with which to fetch %s %s", gvk.Kind, name)
+	}
+	ctx, cancel := readContext()
+	defer cancel()
+	err := reader.Get(ctx, types.NamespacedName{
+		Namespace: ev.Namespace,
+		Name:      name,
+	}, obj)
+	if err == nil || apierrors.IsNotFound(err) {
+		ev.recordQuery(Query{GVK: gvk, Namespace: ev.Namespace, Name: name})
+	}
+	return readError(err)
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func Test_Query(t *testing.T) {
+	configMapGVK := schema.GroupVersionKind{Version: "v1", Kind: "ConfigMap"}
+	object := func(gvk schema.GroupVersionKind, namespace, name string, labels map[string]string) *unstructured.Unstructured {
+		var obj unstructured.Unstructured
+		obj.SetGroupVersionKind(gvk)
+		obj.SetNamespace(namespace)
+		obj.SetName(name)
+		obj.SetLabels(labels)
+		return &obj
+	}
+
+	t.Run("matches a named object", func(t *testing.T) {
+		g := NewWithT(t)
+		q := Query{GVK: configMapGVK, Namespace: "ns", Name: "foo"}
+		g.Expect(q.Matches(object(configMapGVK, "ns", "foo", nil))).To(BeTrue())
+		g.Expect(q.Matches(object(configMapGVK, "ns", "bar", nil))).To(BeFalse())
+		g.Expect(q.Matches(object(configMapGVK, "other", "foo", nil))).To(BeFalse())
+		g.Expect(q.Matches(object(schema.GroupVersionKind{Version: "v1", Kind: "Secret"}, "ns", "foo", nil))).To(BeFalse())
+	})
+
+	t.Run("matches selected objects", func(t *testing.T) {
+		g := NewWithT(t)
+		q := Query{GVK: configMapGVK, Namespace: "ns", Selector: labels.SelectorFromSet(labels.Set{"app": "foo"})}
+		g.Expect(q.Matches(object(configMapGVK, "ns", "a", map[string]string{"app": "foo"}))).To(BeTrue())
+		g.Expect(q.Matches(object(configMapGVK, "ns", "b", map[string]string{"app": "bar"}))).To(BeFalse())
+		g.Expect(q.Matches(object(configMapGVK, "other", "a", map[string]string{"app": "foo"}))).To(BeFalse())
+	})
+
+	t.Run("matches objects in all namespaces", func(t *testing.T) {
+		g := NewWithT(t)
+		q := Query{GVK: configMapGVK, Selector: labels.Everything()}
+		g.Expect(q.Matches(object(configMapGVK, "ns", "a", nil))).To(BeTrue())
+		g.Expect(q.Matches(object(configMapGVK, "other", "b", nil))).To(BeTrue())
+	})
+
+	t.Run("matches cluster-scoped objects", func(t *testing.T) {
+		g := NewWithT(t)
+		namespaceGVK := schema.GroupVersionKind{Version: "v1", Kind: "Namespace"}
+		q := Query{GVK: namespaceGVK, Namespace: "ns", Name: "foo"}
+		g.Expect(q.Matches(object(namespaceGVK, "", "foo", nil))).To(BeTrue())
+	})
+}
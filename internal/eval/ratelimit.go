@@ -0,0 +1,127 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// retryBaseDelay is how long to wait before the first retry of a
+	// failed request; each subsequent retry waits twice as long as
+	// the one before.
+	retryBaseDelay = time.Second
+	// maxRetryWait is the longest a server can ask us to wait (with
+	// Retry-After) before retrying. If it asks for longer, the
+	// request fails with a RateLimitError instead, so the
+	// comprehension can be requeued rather than tying up a worker.
+	maxRetryWait = 10 * time.Second
+)
+
+// RateLimitError is returned when a request generator has been rate
+// limited, and should not be tried again until Reset.
+type RateLimitError struct {
+	URL   string
+	Reset time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited fetching %s until %s", e.URL, e.Reset.Format(time.RFC3339))
+}
+
+// retryableError is a failure which may succeed if the request is
+// tried again.
+type retryableError struct {
+	err error
+	// after is how long the server asked to wait before retrying, if
+	// it said; otherwise zero.
+	after time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// checkRateLimit looks at a response which was not successful, and
+// returns a RateLimitError if it indicates the client has exhausted
+// its rate limit, or a retryableError if it is worth trying again
+// (soon). Otherwise it returns nil.
+func checkRateLimit(resp *http.Response) error {
+	url := resp.Request.URL.String()
+
+	// GitHub (and others) say when the rate limit will reset, with
+	// the time in epoch seconds.
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests {
+		if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+				return &RateLimitError{URL: url, Reset: time.Unix(reset, 0)}
+			}
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		after := retryAfter(resp.Header.Get("Retry-After"))
+		if after > maxRetryWait {
+			return &RateLimitError{URL: url, Reset: time.Now().Add(after)}
+		}
+		return &retryableError{
+			err:   fmt.Errorf("got status %d", resp.StatusCode),
+			after: after,
+		}
+	}
+	return nil
+}
+
+// retryAfter parses the value of a Retry-After header, which may be
+// a number of seconds, or an HTTP date. It returns zero if the value
+// is missing or cannot be parsed.
+func retryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// backoff gives how long to wait before the retry following the
+// given (zero-based) attempt.
+func backoff(attempt int, err *retryableError) time.Duration {
+	if err.after > 0 {
+		return err.after
+	}
+	// Stop doubling once past the longest wait, so as not to overflow.
+	delay := retryBaseDelay
+	for i := 0; i < attempt && delay < maxRetryWait; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryWait {
+		return maxRetryWait
+	}
+	return delay
+}
@@ -0,0 +1,706 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	neturl "net/url"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	celtypes "github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+	corev1 "k8s.io/api/core/v1"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+// == request
+
+func compileRequest(e *env, expr *generate.Generator) (eagerGeneratorFunc, error) {
+	request := expr.Request.DeepCopy()
+	ce, err := e.celEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var evals []evaluationFunc
+	urlEval, err := compileString(ce, request.URL, replaceStrPointer(&request.URL))
+	if err != nil {
+		return nil, err
+	}
+	if urlEval != nil {
+		evals = append(evals, urlEval)
+	}
+
+	for i := range request.Headers {
+		headerEval, err := compileString(ce, request.Headers[i], replaceStrPointer(&request.Headers[i]))
+		if err != nil {
+			return nil, err
+		}
+		if headerEval != nil {
+			evals = append(evals, headerEval)
+		}
+	}
+
+	bodyTemplate, err := compileRequestBody(e, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// expressions about the response have the variable `body` in
+	// addition to any others in scope.
+	bodyEnv, err := (&env{name: "body", next: e}).celEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	var itemsProg cel.Program
+	if request.Items != "" {
+		itemsProg, err = compileExpr(bodyEnv, request.Items)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var nextProg cel.Program
+	if p := request.Paginate; p != nil {
+		switch {
+		case p.Link && p.Next != "":
+			return nil, fmt.Errorf("only one of paginate.link and paginate.next can be given")
+		case p.Next != "":
+			nextProg, err = compileExpr(bodyEnv, p.Next)
+			if err != nil {
+				return nil, err
+			}
+		case !p.Link:
+			return nil, fmt.Errorf("paginate must give one of .link or .next")
+		}
+	}
+
+	return func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error) {
+		for i := range evals {
+			if err := evals[i](ar); err != nil {
+				return nil, err
+			}
+		}
+		var next nextPageFunc
+		switch {
+		case nextProg != nil:
+			next = nextFromExpr(nextProg, ar)
+		case request.Paginate != nil:
+			next = nextFromLink
+		}
+		var items itemsFunc
+		if itemsProg != nil {
+			items = itemsFromExpr(itemsProg, ar)
+		}
+		var body *requestBody
+		if bodyTemplate != nil {
+			val, err := bodyTemplate.evaluate(ar)
+			if err != nil {
+				return nil, err
+			}
+			body, err = encodeRequestBody(val)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return ev.generateRequest(request, body, items, next)
+	}, nil
+}
+
+// compileRequestBody gives a template for the body of the request,
+// or nil if there is no body to send.
+func compileRequestBody(e *env, request *generate.HttpRequest) (*template, error) {
+	var body interface{}
+	switch {
+	case request.Body != nil && request.GraphQL != nil:
+		return nil, fmt.Errorf("only one of body and graphql can be given")
+	case request.Body != nil:
+		if err := json.Unmarshal(request.Body.Raw, &body); err != nil {
+			return nil, fmt.Errorf("cannot decode request body: %w", err)
+		}
+	case request.GraphQL != nil:
+		query := map[string]interface{}{
+			"query": request.GraphQL.Query,
+		}
+		if request.GraphQL.Variables != nil {
+			var variables interface{}
+			if err := json.Unmarshal(request.GraphQL.Variables.Raw, &variables); err != nil {
+				return nil, fmt.Errorf("cannot decode GraphQL variables: %w", err)
+			}
+			query["variables"] = variables
+		}
+		body = query
+	default:
+		return nil, nil
+	}
+	return compileTemplate(e, body)
+}
+
+// requestBody is the encoded body of a request, ready to send.
+type requestBody struct {
+	contentType string
+	data        []byte
+}
+
+// encodeRequestBody encodes the value given, which is the result of
+// evaluating a body template. Strings are sent as they are; anything
+// else is encoded as JSON.
+func encodeRequestBody(val interface{}) (*requestBody, error) {
+	if s, ok := val.(string); ok {
+		return &requestBody{contentType: "text/plain", data: []byte(s)}, nil
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode request body as JSON: %w", err)
+	}
+	return &requestBody{contentType: "application/json", data: data}, nil
+}
+
+// itemsFunc selects the values to generate, from the values decoded
+// from a response.
+type itemsFunc func(values []interface{}) ([]interface{}, error)
+
+// nextPageFunc gives the URL of the next page of results, given a
+// response and the values decoded from it; or "" if there are no more
+// pages.
+type nextPageFunc func(resp *response, values []interface{}) (string, error)
+
+// defaultMaxPages is used when pagination is asked for, but
+// .maxPages is not given.
+const defaultMaxPages = 10
+
+func (ev *Evaluator) generateRequest(request *generate.HttpRequest, body *requestBody, items itemsFunc, next nextPageFunc) ([]interface{}, error) {
+	maxPages := 1
+	if next != nil {
+		maxPages = defaultMaxPages
+		if request.Paginate.MaxPages > 0 {
+			maxPages = request.Paginate.MaxPages
+		}
+	}
+
+	opts, err := ev.fetchOptionsFor(request)
+	if err != nil {
+		return nil, err
+	}
+	defer opts.close()
+
+	first, err := neturl.Parse(request.URL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse request URL: %w", err)
+	}
+
+	var result []interface{}
+	url := request.URL
+	for page := 0; url != ""; page++ {
+		// Without an items expression, each value decoded is
+		// generated, so decoding can stop as soon as there are too
+		// many.
+		maxValues := 0
+		if items == nil && opts.maxItems > 0 {
+			maxValues = opts.maxItems - len(result) + 1
+		}
+		values, resp, err := ev.fetchPage(request, url, body, opts, maxValues)
+		if err != nil {
+			return nil, err
+		}
+		if items != nil {
+			selected, err := items(values)
+			if err != nil {
+				return nil, fmt.Errorf("cannot select items from response: %w", err)
+			}
+			result = append(result, selected...)
+		} else {
+			result = append(result, values...)
+		}
+		if opts.maxItems > 0 && len(result) > opts.maxItems {
+			return nil, &LimitError{URL: url, What: "items", Limit: int64(opts.maxItems)}
+		}
+		if next == nil {
+			break
+		}
+		nextURL, err := next(resp, values)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get next page: %w", err)
+		}
+		url, err = resolveURL(resp, nextURL)
+		if err != nil {
+			return nil, err
+		}
+		if url == "" {
+			break
+		}
+		// The next URL comes from the server, and the headers and
+		// credentials are sent with it; so it mustn't be able to send
+		// them elsewhere.
+		if err := checkSameOrigin(first, url); err != nil {
+			return nil, err
+		}
+		// Stopping here would silently leave out the remaining
+		// pages.
+		if page+1 >= maxPages {
+			return nil, &LimitError{URL: request.URL, What: "pages", Limit: int64(maxPages)}
+		}
+	}
+	return result, nil
+}
+
+// checkSameOrigin returns an error if the URL given has a different
+// scheme or host (including port) from the first URL.
+func checkSameOrigin(first *neturl.URL, next string) error {
+	u, err := neturl.Parse(next)
+	if err != nil {
+		return fmt.Errorf("cannot parse next page URL: %w", err)
+	}
+	if !strings.EqualFold(u.Scheme, first.Scheme) || !strings.EqualFold(u.Host, first.Host) {
+		return fmt.Errorf("next page is at %s://%s, but must be at %s://%s, as the request is", u.Scheme, u.Host, first.Scheme, first.Host)
+	}
+	return nil
+}
+
+// fetchPage requests the URL given, with the method, headers and
+// auth from the request generator, and decodes the response. If
+// maxValues is positive, decoding stops when there are more values
+// than that.
+func (ev *Evaluator) fetchPage(request *generate.HttpRequest, url string, body *requestBody, opts fetchOptions, maxValues int) ([]interface{}, *response, error) {
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+		if body != nil {
+			method = http.MethodPost
+		}
+	}
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body.data)
+	}
+	req, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not construct request: %w", err)
+	}
+	if err := ev.Egress.checkURL(req.URL); err != nil {
+		return nil, nil, err
+	}
+	for i := range request.Headers {
+		name, value, ok := strings.Cut(request.Headers[i], ":")
+		if !ok {
+			// don't include the header in the message, it may
+			// well have a credential in it.
+			return nil, nil, fmt.Errorf(`header at index %d is malformed; expected "Name: value"`, i)
+		}
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", body.contentType)
+	}
+	if request.Auth != nil {
+		if err := ev.setRequestAuth(req, request.Auth); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	resp, err := ev.fetch(req, body, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The response may have been fetched earlier, for a request
+	// generator with a higher limit.
+	if opts.maxBodySize > 0 && int64(len(resp.body)) > opts.maxBodySize {
+		return nil, nil, &LimitError{URL: url, What: "response body", Limit: opts.maxBodySize}
+	}
+	format := request.Format
+	if format == "" {
+		format = formatFromContentType(resp.header.Get("Content-Type"))
+	}
+	result, err := decodeResponse(format, bytes.NewReader(resp.body), maxValues)
+	if err == errTooManyValues {
+		return nil, nil, &LimitError{URL: url, What: "items", Limit: int64(opts.maxItems)}
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("cannot decode response: %w", err)
+	}
+	return result, resp, nil
+}
+
+// fetchOptions are the settings, per request generator, for fetching
+// a URL.
+type fetchOptions struct {
+	client *http.Client
+	// ownClient is true if the client was made just for the request
+	// generator, and should be closed after.
+	ownClient bool
+	// transport identifies the credentials, certificates and proxy
+	// used, as part of the key for responses.
+	transport string
+	timeout   time.Duration
+	// retries is the number of retries asked for, or -1 if not given,
+	// in which case it depends on the method (see retriesFor).
+	retries int
+	// maxBodySize and maxItems are not enforced if zero.
+	maxBodySize int64
+	maxItems    int
+}
+
+// close releases any resources held for fetching, in particular
+// idle connections in a transport made just for the request
+// generator.
+func (opts fetchOptions) close() {
+	if opts.ownClient {
+		opts.client.CloseIdleConnections()
+	}
+}
+
+const (
+	// defaultTimeout is used when a request generator doesn't give
+	// .timeout.
+	defaultTimeout = 30 * time.Second
+	// defaultRetries is used when a request generator doesn't give
+	// .retries.
+	defaultRetries = 3
+	// maxTimeout and maxRetries are the most a request generator can
+	// ask for, so that one can't hold up an evaluation for long.
+	maxTimeout = 5 * time.Minute
+	maxRetries = 10
+	// defaultMaxBodySize is used when a request generator doesn't
+	// give .maxBodySize.
+	defaultMaxBodySize = 10 << 20
+)
+
+// maxDownloadSize is the most that a generator which fetches a whole
+// archive or repository can download.
+func (ev *Evaluator) maxDownloadSize() int64 {
+	if ev.MaxBodySize > 0 {
+		return ev.MaxBodySize
+	}
+	return defaultMaxBodySize
+}
+
+// LimitError is returned when a response is bigger than allowed,
+// either in bytes or in the number of items.
+type LimitError struct {
+	URL   string
+	What  string
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s from %s exceeds the limit of %d", e.What, e.URL, e.Limit)
+}
+
+func (ev *Evaluator) fetchOptionsFor(request *generate.HttpRequest) (fetchOptions, error) {
+	client, own, err := ev.httpClientFor(request)
+	if err != nil {
+		return fetchOptions{}, err
+	}
+	opts := fetchOptions{
+		client:    client,
+		ownClient: own,
+		transport: ev.transportIdentity(request),
+		timeout:   defaultTimeout,
+		retries:   -1,
+	}
+	if request.Timeout != nil {
+		if d := request.Timeout.Duration; d <= 0 || d > maxTimeout {
+			opts.close()
+			return fetchOptions{}, fmt.Errorf("request timeout must be positive and at most %s, but is %s", maxTimeout, d)
+		}
+		opts.timeout = request.Timeout.Duration
+	}
+	if request.Retries != nil {
+		if n := *request.Retries; n < 0 || n > maxRetries {
+			opts.close()
+			return fetchOptions{}, fmt.Errorf("request retries must be between 0 and %d, but is %d", maxRetries, n)
+		}
+		opts.retries = *request.Retries
+	}
+
+	opts.maxBodySize = defaultMaxBodySize
+	if request.MaxBodySize != nil {
+		opts.maxBodySize = request.MaxBodySize.Value()
+	}
+	if ev.MaxBodySize > 0 && (opts.maxBodySize <= 0 || opts.maxBodySize > ev.MaxBodySize) {
+		opts.maxBodySize = ev.MaxBodySize
+	}
+	if request.MaxItems != nil {
+		opts.maxItems = *request.MaxItems
+	}
+	if ev.MaxItems > 0 && (opts.maxItems <= 0 || opts.maxItems > ev.MaxItems) {
+		opts.maxItems = ev.MaxItems
+	}
+	return opts, nil
+}
+
+// retriesFor gives the number of times to retry a request with the
+// method given. Unless the request generator asks for retries, only
+// idempotent methods are retried, since repeating e.g. a POST might
+// do whatever it does twice.
+func (opts fetchOptions) retriesFor(method string) int {
+	if opts.retries >= 0 {
+		return opts.retries
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return defaultRetries
+	}
+	return 0
+}
+
+// fetch does the request given, or reuses the response from an
+// identical request made earlier in the evaluation. If the evaluator
+// has a response cache, the request is made conditional on any
+// response cached from an earlier evaluation being out of date.
+// Failures that may be temporary are retried, up to the number of
+// retries in the options.
+func (ev *Evaluator) fetch(req *http.Request, body *requestBody, opts fetchOptions) (*response, error) {
+	key := requestKey(req, body, opts.transport)
+	if resp, ok := ev.responses[key]; ok {
+		return resp, nil
+	}
+
+	var cached *response
+	if ev.Cache != nil {
+		if cached = ev.Cache.get(key); cached != nil {
+			setConditional(req, cached)
+		}
+	}
+
+	var resp *response
+	retries := opts.retriesFor(req.Method)
+	for attempt := 0; ; attempt++ {
+		var err error
+		resp, err = ev.attempt(req, cached, opts)
+		if err == nil {
+			break
+		}
+		var retryable *retryableError
+		if !errors.As(err, &retryable) || attempt >= retries {
+			return nil, err
+		}
+		time.Sleep(backoff(attempt, retryable))
+	}
+
+	if ev.Cache != nil && resp != cached {
+		ev.Cache.put(key, resp)
+	}
+	if ev.responses == nil {
+		ev.responses = map[string]*response{}
+	}
+	ev.responses[key] = resp
+	return resp, nil
+}
+
+// attempt makes a single try at the request, giving up if it takes
+// longer than the timeout in the options.
+func (ev *Evaluator) attempt(req *http.Request, cached *response, opts fetchOptions) (*response, error) {
+	ctx, cancel := context.WithTimeout(context.TODO(), opts.timeout)
+	defer cancel()
+	req = req.Clone(ctx)
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = body
+	}
+
+	httpResp, err := opts.client.Do(req)
+	if err != nil {
+		err = fmt.Errorf("could not fetch generator URL: %w", err)
+		// the policy won't have changed by the next try.
+		var egressErr *EgressError
+		if errors.As(err, &egressErr) {
+			return nil, err
+		}
+		return nil, &retryableError{err: err}
+	}
+	defer httpResp.Body.Close()
+
+	switch {
+	case httpResp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached, nil
+	case httpResp.StatusCode == http.StatusOK:
+		data, err := readBody(httpResp, opts.maxBodySize)
+		if err != nil {
+			return nil, err
+		}
+		return &response{
+			url:    httpResp.Request.URL,
+			header: httpResp.Header,
+			body:   data,
+		}, nil
+	}
+	if err := checkRateLimit(httpResp); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("got status %d", httpResp.StatusCode)
+}
+
+// readBody reads the body of the response, failing rather than
+// reading more than maxBodySize bytes (if positive).
+func readBody(resp *http.Response, maxBodySize int64) ([]byte, error) {
+	if maxBodySize <= 0 {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, &retryableError{err: fmt.Errorf("could not read response: %w", err)}
+		}
+		return data, nil
+	}
+
+	limitErr := &LimitError{URL: resp.Request.URL.String(), What: "response body", Limit: maxBodySize}
+	if resp.ContentLength > maxBodySize {
+		return nil, limitErr
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize+1))
+	if err != nil {
+		return nil, &retryableError{err: fmt.Errorf("could not read response: %w", err)}
+	}
+	if int64(len(data)) > maxBodySize {
+		return nil, limitErr
+	}
+	return data, nil
+}
+
+// resolveURL resolves a possibly relative URL against the URL of the
+// request that elicited the response.
+func resolveURL(resp *response, ref string) (string, error) {
+	if ref == "" {
+		return "", nil
+	}
+	u, err := neturl.Parse(ref)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse next page URL: %w", err)
+	}
+	return resp.url.ResolveReference(u).String(), nil
+}
+
+// bodyValue gives the value to use for the response body in
+// expressions: if the response was a single value, that value;
+// otherwise, the list of values.
+func bodyValue(values []interface{}) interface{} {
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+// evalWithBody evaluates the program given, with the decoded response
+// as the variable `body` in addition to the variables in the
+// activation record.
+func evalWithBody(prog cel.Program, ar map[string]interface{}, values []interface{}) (ref.Val, error) {
+	activation := map[string]interface{}{}
+	for k, v := range ar {
+		activation[k] = v
+	}
+	activation["body"] = bodyValue(values)
+	val, _, err := prog.Eval(activation)
+	return val, err
+}
+
+// itemsFromExpr gives an itemsFunc that evaluates the expression
+// given, which must result in a list.
+func itemsFromExpr(prog cel.Program, ar map[string]interface{}) itemsFunc {
+	return func(values []interface{}) ([]interface{}, error) {
+		ref, err := evalWithBody(prog, ar, values)
+		if err != nil {
+			return nil, err
+		}
+		val, err := nativeValue(ref)
+		if err != nil {
+			return nil, err
+		}
+		items, ok := val.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("items expression must evaluate to a list")
+		}
+		return items, nil
+	}
+}
+
+// nextFromExpr gives a nextPageFunc that evaluates the expression
+// given, with the decoded response body as `body`.
+func nextFromExpr(prog cel.Program, ar map[string]interface{}) nextPageFunc {
+	return func(_ *response, values []interface{}) (string, error) {
+		ref, err := evalWithBody(prog, ar, values)
+		if err != nil {
+			return "", err
+		}
+		if ref.Type() == celtypes.NullType {
+			return "", nil
+		}
+		if s, ok := ref.Value().(string); ok {
+			return s, nil
+		}
+		return "", fmt.Errorf("next page expression must evaluate to a string or null")
+	}
+}
+
+// nextFromLink is a nextPageFunc that looks for a `Link` header
+// with `rel="next"`, e.g.,
+//
+//	Link: <https://api.github.com/repositories/1300192/issues?page=4>; rel="next"
+func nextFromLink(resp *response, _ []interface{}) (string, error) {
+	for _, header := range resp.header.Values("Link") {
+		for _, link := range strings.Split(header, ",") {
+			segments := strings.Split(link, ";")
+			target := strings.TrimSpace(segments[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range segments[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.TrimSpace(key) != "rel" {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(value, `"`)) {
+					if rel == "next" {
+						return strings.Trim(target, "<>"), nil
+					}
+				}
+			}
+		}
+	}
+	return "", nil
+}
+
+// setRequestAuth fetches the secret referred to, and uses its fields
+// to set the Authorization header of the request.
+func (ev *Evaluator) setRequestAuth(req *http.Request, auth *generate.RequestAuth) error {
+	var secret corev1.Secret
+	if err := ev.getLocalObject(auth.SecretRef.Name, &secret); err != nil {
+		return fmt.Errorf("unable to fetch secret for request auth: %w", err)
+	}
+
+	if token, ok := secret.Data["bearerToken"]; ok {
+		req.Header.Set("Authorization", "Bearer "+string(token))
+		return nil
+	}
+	username, hasUsername := secret.Data["username"]
+	password, hasPassword := secret.Data["password"]
+	if hasUsername && hasPassword {
+		req.SetBasicAuth(string(username), string(password))
+		return nil
+	}
+	return fmt.Errorf("secret %q has neither a bearerToken field, nor username and password fields", auth.SecretRef.Name)
+}
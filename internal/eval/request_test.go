@@ -0,0 +1,907 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	neturl "net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+// echoHeaders responds with the headers of the request, as a JSON
+// object.
+func echoHeaders(w http.ResponseWriter, r *http.Request) {
+	headers := map[string]string{}
+	for k := range r.Header {
+		headers[k] = r.Header.Get(k)
+	}
+	json.NewEncoder(w).Encode(headers)
+}
+
+// selfSignedCAPEM makes a CA certificate, and returns it PEM-encoded.
+func selfSignedCAPEM(g Gomega) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	g.Expect(err).NotTo(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	g.Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// echoRequest responds with the method, content type, and body of
+// the request, as a JSON object.
+func echoRequest(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"method":      r.Method,
+		"contentType": r.Header.Get("Content-Type"),
+		"body":        string(body),
+	})
+}
+
+// pages serves three pages, each an object giving the page number.
+// Each page links to the next with a Link header, as well as in a
+// field in the body.
+func pages(w http.ResponseWriter, r *http.Request) {
+	const lastPage = 3
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page == 0 {
+		page = 1
+	}
+	body := map[string]interface{}{
+		"page": page,
+		"next": nil,
+	}
+	if page < lastPage {
+		next := fmt.Sprintf("/pages?page=%d", page+1)
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="next", </pages?page=%d>; rel="last"`, next, lastPage))
+		body["next"] = next
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func Test_request(t *testing.T) {
+	t.Run("there's a request generator", func(t *testing.T) {
+		g := NewWithT(t)
+		var requestGenerator = `
+request:
+  url: ` + baseurl + `/flux-whatif-pulls.json
+`
+		// The returned item is itself a list, hence the nested
+		// ConsistOf -- saying "the result is a list, consisting of an
+		// element which is a list consisting of ...".
+		expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(ConsistOf(
+			matchKeys(map[string]interface{}{
+				"url": "https://api.github.com/repos/squaremo/flux-whatif-example/pulls/1",
+				"head": map[string]interface{}{
+					"ref": "nodeport",
+					"sha": "aa1aed98a09a43f3bb20854fe9de5039f7a9a473",
+				},
+			}),
+		)))
+	})
+
+	t.Run("there's a request generator with a format", func(t *testing.T) {
+		g := NewWithT(t)
+		var requestGenerator = `
+request:
+  url: ` + baseurl + `/podinfo-index.yaml
+  format: yaml
+  items: body.entries.podinfo
+`
+		expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(
+			matchKeys(map[string]interface{}{"version": "6.3.0"}),
+			matchKeys(map[string]interface{}{"version": "6.2.3"}),
+		))
+	})
+
+	t.Run("there's a request generator with an items expression", func(t *testing.T) {
+		t.Run("selecting the whole body", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + baseurl + `/flux2-pulls.json
+  items: body
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, HaveLen(14))
+		})
+
+		t.Run("filtering the body", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + baseurl + `/flux2-pulls.json
+  items: body.filter(pr, pr.number > 4000.0)
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(
+				matchKeys(map[string]interface{}{"number": float64(4017)}),
+				matchKeys(map[string]interface{}{"number": float64(4006)}),
+			))
+		})
+	})
+
+	t.Run("there's a request generator with a body", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(echoRequest))
+		defer server.Close()
+
+		t.Run("giving an object", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  body:
+    sum: ${1 + 2}
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(matchKeys(map[string]interface{}{
+				"method":      "POST",
+				"contentType": "application/json",
+				"body":        `{"sum":3}`,
+			})))
+		})
+
+		t.Run("giving a string and a method", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  method: PUT
+  body: "sum=${1 + 2}"
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(matchKeys(map[string]interface{}{
+				"method":      "PUT",
+				"contentType": "text/plain",
+				"body":        "sum=3",
+			})))
+		})
+
+		t.Run("giving a GraphQL query", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  graphql:
+    query: "query($count: Int!) { viewer { repositories(first: $count) { nodes { name } } } }"
+    variables:
+      count: ${2 * 5}
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(matchKeys(map[string]interface{}{
+				"method":      "POST",
+				"contentType": "application/json",
+				"body":        `{"query":"query($count: Int!) { viewer { repositories(first: $count) { nodes { name } } } }","variables":{"count":10}}`,
+			})))
+		})
+	})
+
+	t.Run("there's a request generator with headers", func(t *testing.T) {
+		g := NewWithT(t)
+		server := httptest.NewServer(http.HandlerFunc(echoHeaders))
+		defer server.Close()
+
+		var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  headers:
+  - "Accept: application/vnd.github+json"
+  - "X-GitHub-Api-Version:2022-11-28"
+`
+		expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(matchKeys(map[string]interface{}{
+			"Accept":               "application/vnd.github+json",
+			"X-Github-Api-Version": "2022-11-28",
+		})))
+	})
+
+	t.Run("there's a request generator with auth from a secret", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(echoHeaders))
+		defer server.Close()
+
+		var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  auth:
+    secretRef:
+      name: creds
+`
+		t.Run("using a bearer token", func(t *testing.T) {
+			g := NewWithT(t)
+			namespace, ev := newNamespaceAndEval(g)
+			var secret corev1.Secret
+			secret.Name = "creds"
+			secret.Namespace = namespace
+			secret.StringData = map[string]string{
+				"bearerToken": "sekrit",
+			}
+			g.Expect(k8sClient.Create(context.TODO(), &secret)).To(Succeed())
+
+			expectGeneratorItems(g, requestGenerator, ev, ConsistOf(matchKeys(map[string]interface{}{
+				"Authorization": "Bearer sekrit",
+			})))
+		})
+
+		t.Run("using a username and password", func(t *testing.T) {
+			g := NewWithT(t)
+			namespace, ev := newNamespaceAndEval(g)
+			var secret corev1.Secret
+			secret.Name = "creds"
+			secret.Namespace = namespace
+			secret.StringData = map[string]string{
+				"username": "foo",
+				"password": "bar",
+			}
+			g.Expect(k8sClient.Create(context.TODO(), &secret)).To(Succeed())
+
+			expectGeneratorItems(g, requestGenerator, ev, ConsistOf(matchKeys(map[string]interface{}{
+				"Authorization": "Basic Zm9vOmJhcg==",
+			})))
+		})
+	})
+
+	t.Run("there's a request generator for a server with its own CA", func(t *testing.T) {
+		server := httptest.NewTLSServer(http.HandlerFunc(echoHeaders))
+		defer server.Close()
+		caPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: server.Certificate().Raw,
+		})
+
+		t.Run("fails without the CA", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  retries: 0
+`
+			err := expectGeneratorError(g, requestGenerator, &Evaluator{})
+			var unknownAuthority x509.UnknownAuthorityError
+			g.Expect(errors.As(err, &unknownAuthority)).To(BeTrue())
+		})
+
+		t.Run("using a CA from a secret", func(t *testing.T) {
+			g := NewWithT(t)
+			namespace, ev := newNamespaceAndEval(g)
+			var secret corev1.Secret
+			secret.Name = "tls"
+			secret.Namespace = namespace
+			secret.Data = map[string][]byte{
+				"ca.crt": caPEM,
+			}
+			g.Expect(k8sClient.Create(context.TODO(), &secret)).To(Succeed())
+
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  tls:
+    secretRef:
+      name: tls
+`
+			expectGeneratorItems(g, requestGenerator, ev, HaveLen(1))
+		})
+
+		t.Run("using a CA from a configmap", func(t *testing.T) {
+			g := NewWithT(t)
+			namespace, ev := newNamespaceAndEval(g)
+			var cm corev1.ConfigMap
+			cm.Name = "ca"
+			cm.Namespace = namespace
+			cm.Data = map[string]string{
+				"ca.crt": string(caPEM),
+			}
+			g.Expect(k8sClient.Create(context.TODO(), &cm)).To(Succeed())
+
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  tls:
+    caConfigMapRef:
+      name: ca
+`
+			expectGeneratorItems(g, requestGenerator, ev, HaveLen(1))
+		})
+
+		t.Run("using CAs from both a secret and a configmap", func(t *testing.T) {
+			g := NewWithT(t)
+			// The CA in the secret doesn't end with a newline, which
+			// mustn't stop the CA in the configmap being used.
+			var secret corev1.Secret
+			secret.Name = "tls"
+			secret.Namespace = "default"
+			secret.Data = map[string][]byte{
+				"ca.crt": bytes.TrimSpace(selfSignedCAPEM(g)),
+			}
+			var cm corev1.ConfigMap
+			cm.Name = "ca"
+			cm.Namespace = "default"
+			cm.Data = map[string]string{
+				"ca.crt": string(caPEM),
+			}
+			ev := &Evaluator{
+				Client:    fake.NewClientBuilder().WithObjects(&secret, &cm).Build(),
+				Namespace: "default",
+			}
+
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  tls:
+    secretRef:
+      name: tls
+    caConfigMapRef:
+      name: ca
+`
+			expectGeneratorItems(g, requestGenerator, ev, HaveLen(1))
+		})
+	})
+
+	t.Run("there's a request generator with a proxy", func(t *testing.T) {
+		// A proxy is sent the whole URL in the request line; this
+		// one just reports it.
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"proxied": r.URL.String(),
+			})
+		}))
+		defer proxy.Close()
+
+		g := NewWithT(t)
+		var requestGenerator = `
+request:
+  url: http://example.invalid/thing
+  proxy: ` + proxy.URL + `
+`
+		expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(matchKeys(map[string]interface{}{
+			"proxied": "http://example.invalid/thing",
+		})))
+	})
+
+	t.Run("there's a request generator and an egress policy", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(echoHeaders))
+		defer server.Close()
+		serverURL, err := neturl.Parse(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectEgressDenied := func(g *WithT, requestGenerator string, policy *EgressPolicy) {
+			err := expectGeneratorError(g, requestGenerator, &Evaluator{Egress: policy})
+			var egressErr *EgressError
+			g.Expect(errors.As(err, &egressErr)).To(BeTrue(), "expected an EgressError, got %v", err)
+		}
+
+		t.Run("allows requests to allowed hosts", func(t *testing.T) {
+			g := NewWithT(t)
+			policy, err := NewEgressPolicy([]string{"127.0.0.*"}, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{Egress: policy}, HaveLen(1))
+		})
+
+		t.Run("refuses hosts not allowed", func(t *testing.T) {
+			g := NewWithT(t)
+			policy, err := NewEgressPolicy([]string{"*.example.com"}, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+`
+			expectEgressDenied(g, requestGenerator, policy)
+		})
+
+		t.Run("refuses hosts after interpolation", func(t *testing.T) {
+			g := NewWithT(t)
+			policy, err := NewEgressPolicy([]string{"*.example.com"}, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+			var requestGenerator = `
+request:
+  url: http://${"169.254.169.254"}/latest/meta-data
+`
+			expectEgressDenied(g, requestGenerator, policy)
+		})
+
+		t.Run("refuses denied addresses", func(t *testing.T) {
+			g := NewWithT(t)
+			policy, err := NewEgressPolicy(nil, []string{"127.0.0.0/8"})
+			g.Expect(err).NotTo(HaveOccurred())
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+`
+			expectEgressDenied(g, requestGenerator, policy)
+		})
+
+		t.Run("refuses host names that resolve to denied addresses", func(t *testing.T) {
+			g := NewWithT(t)
+			policy, err := NewEgressPolicy(nil, []string{"127.0.0.0/8", "::1/128"})
+			g.Expect(err).NotTo(HaveOccurred())
+			var requestGenerator = `
+request:
+  url: http://localhost:` + serverURL.Port() + `
+`
+			expectEgressDenied(g, requestGenerator, policy)
+		})
+
+		t.Run("refuses redirects to hosts not allowed", func(t *testing.T) {
+			g := NewWithT(t)
+			redirector := httptest.NewServer(http.RedirectHandler("http://metadata.internal/", http.StatusFound))
+			defer redirector.Close()
+			policy, err := NewEgressPolicy([]string{"127.0.0.1"}, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+			var requestGenerator = `
+request:
+  url: ` + redirector.URL + `
+`
+			expectEgressDenied(g, requestGenerator, policy)
+		})
+
+		t.Run("refuses proxies not allowed", func(t *testing.T) {
+			g := NewWithT(t)
+			policy, err := NewEgressPolicy([]string{"*.example.com"}, nil)
+			g.Expect(err).NotTo(HaveOccurred())
+			var requestGenerator = `
+request:
+  url: http://api.example.com/
+  proxy: ` + server.URL + `
+`
+			expectEgressDenied(g, requestGenerator, policy)
+		})
+
+		t.Run("checks host names that go through a proxy", func(t *testing.T) {
+			g := NewWithT(t)
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"proxied": r.URL.String(),
+				})
+			}))
+			defer proxy.Close()
+
+			policy, err := NewEgressPolicy(nil, []string{"10.0.0.0/8"})
+			g.Expect(err).NotTo(HaveOccurred())
+			policy.lookupIP = func(_ context.Context, _, host string) ([]net.IP, error) {
+				if host == "internal.example.com" {
+					return []net.IP{net.ParseIP("203.0.113.1"), net.ParseIP("10.0.0.1")}, nil
+				}
+				return []net.IP{net.ParseIP("203.0.113.1")}, nil
+			}
+
+			expectEgressDenied(g, `
+request:
+  url: http://internal.example.com/
+  proxy: `+proxy.URL+`
+`, policy)
+			expectGeneratorItems(g, `
+request:
+  url: http://api.example.com/
+  proxy: `+proxy.URL+`
+`, &Evaluator{Egress: policy}, ConsistOf(matchKeys(map[string]interface{}{
+				"proxied": "http://api.example.com/",
+			})))
+		})
+
+		t.Run("ignores the proxy from the environment", func(t *testing.T) {
+			g := NewWithT(t)
+			policy, err := NewEgressPolicy(nil, []string{"10.0.0.0/8"})
+			g.Expect(err).NotTo(HaveOccurred())
+			g.Expect(policy.transport().Proxy).To(BeNil())
+		})
+	})
+
+	t.Run("there's a request generator with pagination", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(pages))
+		defer server.Close()
+
+		matchPages := func(n ...float64) []interface{} {
+			var matchers []interface{}
+			for i := range n {
+				matchers = append(matchers, matchKeys(map[string]interface{}{
+					"page": n[i],
+				}))
+			}
+			return matchers
+		}
+
+		t.Run("following Link headers", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `/pages
+  paginate:
+    link: true
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(matchPages(1, 2, 3)...))
+		})
+
+		t.Run("using an expression", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `/pages
+  paginate:
+    next: body.next
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(matchPages(1, 2, 3)...))
+		})
+
+		t.Run("selecting items from each page", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `/pages
+  items: '[body.page]'
+  paginate:
+    link: true
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, Equal([]interface{}{
+				float64(1), float64(2), float64(3),
+			}))
+		})
+
+		t.Run("with a maximum number of pages", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `/pages
+  paginate:
+    link: true
+    maxPages: 3
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, ConsistOf(matchPages(1, 2, 3)...))
+		})
+
+		t.Run("with more pages than the maximum", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `/pages
+  paginate:
+    link: true
+    maxPages: 2
+`
+			err := expectGeneratorError(g, requestGenerator, &Evaluator{})
+			var limitErr *LimitError
+			g.Expect(errors.As(err, &limitErr)).To(BeTrue(), "expected a LimitError, got %v", err)
+			g.Expect(limitErr.What).To(Equal("pages"))
+		})
+
+		t.Run("refuses a next page on another host", func(t *testing.T) {
+			g := NewWithT(t)
+			var sentTo []string
+			other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				sentTo = append(sentTo, r.Header.Get("Authorization"))
+				w.Write([]byte(`{"next": null}`))
+			}))
+			defer other.Close()
+			// A different port on the same host is a different origin.
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `/pages
+  headers:
+  - "Authorization: Bearer secret"
+  paginate:
+    next: '"` + other.URL + `/stolen"'
+`
+			err := expectGeneratorError(g, requestGenerator, &Evaluator{})
+			g.Expect(err.Error()).To(ContainSubstring("next page"))
+			g.Expect(sentTo).To(BeEmpty())
+		})
+	})
+
+	t.Run("there's a request generator that's used repeatedly", func(t *testing.T) {
+		var fetched, notModified int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			const etag = `"v1"`
+			if r.Header.Get("If-None-Match") == etag {
+				notModified++
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fetched++
+			w.Header().Set("ETag", etag)
+			w.Write([]byte(`["foo", "bar"]`))
+		}))
+		defer server.Close()
+
+		var spec generate.ComprehensionSpec
+		if err := yaml.Unmarshal([]byte(`
+for:
+- var: x
+  in:
+    list: [1, 2, 3]
+- var: words
+  in:
+    request:
+      url: `+server.URL+`
+yield:
+  template: ${words}
+`), &spec); err != nil {
+			t.Fatal(err)
+		}
+
+		t.Run("fetches once per evaluation", func(t *testing.T) {
+			g := NewWithT(t)
+			fetched, notModified = 0, 0
+			ev := &Evaluator{}
+			g.Expect(ev.Eval(&spec)).To(HaveLen(3))
+			g.Expect(fetched).To(Equal(1))
+			g.Expect(ev.Eval(&spec)).To(HaveLen(3))
+			g.Expect(fetched).To(Equal(2))
+		})
+
+		t.Run("revalidates responses from the cache", func(t *testing.T) {
+			g := NewWithT(t)
+			fetched, notModified = 0, 0
+			cache := NewResponseCache(10)
+			expected := []interface{}{
+				[]interface{}{"foo", "bar"},
+				[]interface{}{"foo", "bar"},
+				[]interface{}{"foo", "bar"},
+			}
+			ev := &Evaluator{Cache: cache}
+			g.Expect(ev.Eval(&spec)).To(Equal(expected))
+			ev = &Evaluator{Cache: cache}
+			g.Expect(ev.Eval(&spec)).To(Equal(expected))
+			g.Expect(fetched).To(Equal(1))
+			g.Expect(notModified).To(Equal(1))
+		})
+	})
+
+	t.Run("there's a request generator with limits", func(t *testing.T) {
+		// a hundred lines, each eleven bytes long including the newline.
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for i := 0; i < 100; i++ {
+				fmt.Fprintf(w, "line %05d\n", i)
+			}
+		}))
+		defer server.Close()
+
+		expectLimitError := func(g *WithT, requestGenerator string, ev *Evaluator, what string, limit int64) {
+			err := expectGeneratorError(g, requestGenerator, ev)
+			var limitErr *LimitError
+			g.Expect(errors.As(err, &limitErr)).To(BeTrue(), "expected a LimitError, got %v", err)
+			g.Expect(limitErr.What).To(Equal(what))
+			g.Expect(limitErr.Limit).To(Equal(limit))
+		}
+
+		t.Run("is within the limits", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  format: lines
+  maxBodySize: 1100
+  maxItems: 100
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, HaveLen(100))
+		})
+
+		t.Run("fails when the body is too big", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  format: lines
+  maxBodySize: 1Ki
+`
+			expectLimitError(g, requestGenerator, &Evaluator{}, "response body", 1024)
+		})
+
+		t.Run("fails when the body is bigger than the evaluator allows", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  format: lines
+  maxBodySize: 1Mi
+`
+			expectLimitError(g, requestGenerator, &Evaluator{MaxBodySize: 512}, "response body", 512)
+		})
+
+		t.Run("fails when there are too many items", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  format: lines
+  maxItems: 10
+`
+			expectLimitError(g, requestGenerator, &Evaluator{}, "items", 10)
+		})
+
+		t.Run("fails when there are more items than the evaluator allows", func(t *testing.T) {
+			g := NewWithT(t)
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  format: lines
+  items: body.filter(l, l.endsWith("0"))
+`
+			expectLimitError(g, requestGenerator, &Evaluator{MaxItems: 5}, "items", 5)
+		})
+
+		t.Run("counts items over all pages", func(t *testing.T) {
+			g := NewWithT(t)
+			pages := httptest.NewServer(http.HandlerFunc(pages))
+			defer pages.Close()
+			var requestGenerator = `
+request:
+  url: ` + pages.URL + `/pages
+  paginate:
+    link: true
+  maxItems: 2
+`
+			expectLimitError(g, requestGenerator, &Evaluator{}, "items", 2)
+		})
+
+		t.Run("says which generator hit the limit", func(t *testing.T) {
+			g := NewWithT(t)
+			var spec generate.ComprehensionSpec
+			g.Expect(yaml.Unmarshal([]byte(`
+for:
+- var: lines
+  in:
+    request:
+      url: `+server.URL+`
+      maxItems: 10
+yield:
+  template: ${lines}
+`), &spec)).To(Succeed())
+			_, err := (&Evaluator{}).Eval(&spec)
+			g.Expect(err).To(MatchError(ContainSubstring(`generator for "lines"`)))
+		})
+	})
+
+	t.Run("there's a request generator with an unreliable server", func(t *testing.T) {
+		defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+		retryBaseDelay = time.Millisecond
+
+		var failures, attempts int
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts <= failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(`"ok"`))
+		}))
+		defer server.Close()
+
+		t.Run("retries until it succeeds", func(t *testing.T) {
+			g := NewWithT(t)
+			failures, attempts = 2, 0
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+`
+			expectGeneratorItems(g, requestGenerator, &Evaluator{}, Equal([]interface{}{"ok"}))
+			g.Expect(attempts).To(Equal(3))
+		})
+
+		t.Run("gives up after the number of retries", func(t *testing.T) {
+			g := NewWithT(t)
+			failures, attempts = 3, 0
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  retries: 1
+`
+			expectGeneratorError(g, requestGenerator, &Evaluator{})
+			g.Expect(attempts).To(Equal(2))
+		})
+
+		t.Run("doesn't retry a POST unless asked to", func(t *testing.T) {
+			g := NewWithT(t)
+			failures, attempts = 1, 0
+			var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  body: {foo: bar}
+`
+			expectGeneratorError(g, requestGenerator, &Evaluator{})
+			g.Expect(attempts).To(Equal(1))
+
+			failures, attempts = 1, 0
+			expectGeneratorItems(g, requestGenerator+"  retries: 1\n", &Evaluator{}, Equal([]interface{}{"ok"}))
+			g.Expect(attempts).To(Equal(2))
+		})
+
+		t.Run("refuses too many retries", func(t *testing.T) {
+			g := NewWithT(t)
+			expectGeneratorError(g, `
+request:
+  url: `+server.URL+`
+  retries: 100
+`, &Evaluator{})
+		})
+	})
+
+	t.Run("backs off no longer than the longest wait", func(t *testing.T) {
+		g := NewWithT(t)
+		g.Expect(backoff(0, &retryableError{})).To(Equal(retryBaseDelay))
+		g.Expect(backoff(1, &retryableError{})).To(Equal(2 * retryBaseDelay))
+		g.Expect(backoff(100, &retryableError{})).To(Equal(maxRetryWait))
+	})
+
+	t.Run("there's a request generator with a slow server", func(t *testing.T) {
+		g := NewWithT(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`"ok"`))
+		}))
+		defer server.Close()
+
+		var requestGenerator = `
+request:
+  url: ` + server.URL + `
+  timeout: 50ms
+  retries: 0
+`
+		err := expectGeneratorError(g, requestGenerator, &Evaluator{})
+		g.Expect(errors.Is(err, context.DeadlineExceeded)).To(BeTrue())
+	})
+
+	t.Run("there's a request generator which is rate limited", func(t *testing.T) {
+		g := NewWithT(t)
+		reset := time.Now().Add(time.Hour).Truncate(time.Second)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+			w.WriteHeader(http.StatusForbidden)
+		}))
+		defer server.Close()
+
+		var requestGenerator = `
+request:
+  url: ` + server.URL + `
+`
+		err := expectGeneratorError(g, requestGenerator, &Evaluator{})
+		var rateLimited *RateLimitError
+		g.Expect(errors.As(err, &rateLimited)).To(BeTrue())
+		g.Expect(rateLimited.Reset).To(BeTemporally("==", reset))
+	})
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+// == source
+
+// defaultSourceAPIVersion is used when a source generator doesn't
+// give .apiVersion.
+const defaultSourceAPIVersion = "source.toolkit.fluxcd.io/v1beta2"
+
+func compileSource(e *env, expr *generate.Generator) (eagerGeneratorFunc, error) {
+	src := expr.Source.DeepCopy()
+	if (len(src.Directories) == 0) == (len(src.Files) == 0) {
+		return nil, fmt.Errorf("source generator must specify exactly one of .directories and .files")
+	}
+	for _, pattern := range append(src.Directories, src.Files...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	if src.APIVersion == "" {
+		src.APIVersion = defaultSourceAPIVersion
+	}
+
+	ce, err := e.celEnv()
+	if err != nil {
+		return nil, err
+	}
+	nameEval, err := compileString(ce, src.Name, replaceStrPointer(&src.Name))
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ev *Evaluator, ar map[string]interface{}) ([]interface{}, error) {
+		if nameEval != nil {
+			if err := nameEval(ar); err != nil {
+				return nil, err
+			}
+		}
+		return ev.generateSource(src)
+	}, nil
+}
+
+// artifact is the content of an unpacked source artifact.
+type artifact struct {
+	dirs  map[string]bool
+	files map[string][]byte
+}
+
+func (ev *Evaluator) generateSource(src *generate.SourceArtifact) ([]interface{}, error) {
+	art, err := ev.fetchArtifact(src)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []interface{}
+	if len(src.Directories) > 0 {
+		for _, name := range sortedKeys(art.dirs) {
+			if matchAny(src.Directories, name) {
+				result = append(result, map[string]interface{}{
+					"path": name,
+					"name": path.Base(name),
+				})
+			}
+		}
+		return result, nil
+	}
+
+	for _, name := range sortedKeys(art.files) {
+		if !matchAny(src.Files, name) {
+			continue
+		}
+		values, err := decodeFile(name, src.Format, bytes.NewReader(art.files[name]))
+		if err != nil {
+			return nil, err
+		}
+		for i := range values {
+			result = append(result, map[string]interface{}{
+				"path":    name,
+				"name":    path.Base(name),
+				"content": values[i],
+			})
+		}
+	}
+	return result, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fetchArtifact looks up the source, and fetches and unpacks the
+// artifact given in its status; or reuses the artifact fetched
+// earlier in the evaluation.
+func (ev *Evaluator) fetchArtifact(src *generate.SourceArtifact) (*artifact, error) {
+	gvk := schema.FromAPIVersionAndKind(src.APIVersion, src.Kind)
+	key := gvk.String() + "\x00" + src.Name
+	if art, ok := ev.artifacts[key]; ok {
+		return art, nil
+	}
+
+	var obj unstructured.Unstructured
+	obj.SetGroupVersionKind(gvk)
+	if err := ev.getQueried(gvk, src.Name, &obj); err != nil {
+		return nil, fmt.Errorf("cannot get %s %s: %w", src.Kind, src.Name, err)
+	}
+
+	artifactURL, _, _ := unstructured.NestedString(obj.Object, "status", "artifact", "url")
+	if artifactURL == "" {
+		return nil, fmt.Errorf("%s %s has no artifact yet", src.Kind, src.Name)
+	}
+	// Flux v1 sources give a digest with the algorithm; earlier
+	// versions give a SHA256 checksum.
+	digest, _, _ := unstructured.NestedString(obj.Object, "status", "artifact", "digest")
+	if digest == "" {
+		if checksum, _, _ := unstructured.NestedString(obj.Object, "status", "artifact", "checksum"); checksum != "" {
+			digest = "sha256:" + checksum
+		}
+	}
+
+	maxSize := ev.maxDownloadSize()
+	data, err := ev.downloadArtifact(artifactURL, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyDigest(data, digest); err != nil {
+		return nil, fmt.Errorf("artifact of %s %s: %w", src.Kind, src.Name, err)
+	}
+	art, err := untar(data, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unpack artifact of %s %s: %w", src.Kind, src.Name, err)
+	}
+
+	if ev.artifacts == nil {
+		ev.artifacts = map[string]*artifact{}
+	}
+	ev.artifacts[key] = art
+	return art, nil
+}
+
+// downloadArtifact fetches an artifact. The URL comes from the
+// status of the source, which can be written by whoever can write the
+// source, so it's subject to the egress policy like any URL given in
+// a comprehension; to use source generators under a policy, the
+// policy must allow source-controller.
+func (ev *Evaluator) downloadArtifact(artifactURL string, maxSize int64) ([]byte, error) {
+	u, err := url.Parse(artifactURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse artifact URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("artifact URL has unsupported scheme %q", u.Scheme)
+	}
+	if err := ev.Egress.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), defaultTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, artifactURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot construct request for artifact: %w", err)
+	}
+	resp, err := ev.httpClient().Do(req)
+	if err != nil {
+		var egressErr *EgressError
+		if errors.As(err, &egressErr) {
+			return nil, egressErr
+		}
+		return nil, fmt.Errorf("cannot fetch artifact: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching artifact from %s: %s", artifactURL, resp.Status)
+	}
+	return readBody(resp, maxSize)
+}
+
+func verifyDigest(data []byte, digest string) error {
+	if digest == "" {
+		return nil
+	}
+	algo, expected, _ := strings.Cut(digest, ":")
+	if algo != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %q", algo)
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", expected, actual)
+	}
+	return nil
+}
+
+// untar unpacks a gzipped tarball into memory, failing if the
+// unpacked files add up to more than maxSize bytes.
+func untar(data []byte, maxSize int64) (*artifact, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	art := &artifact{
+		dirs:  map[string]bool{},
+		files: map[string][]byte{},
+	}
+	tr := tar.NewReader(gz)
+	remaining := maxSize
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean(hdr.Name), "/")
+		if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			art.dirs[name] = true
+		case tar.TypeReg:
+			content, err := io.ReadAll(io.LimitReader(tr, remaining+1))
+			if err != nil {
+				return nil, err
+			}
+			remaining -= int64(len(content))
+			if remaining < 0 {
+				return nil, fmt.Errorf("unpacked artifact exceeds the limit of %d bytes", maxSize)
+			}
+			art.files[name] = content
+			// Tarballs don't always have entries for directories, so
+			// make sure the file's parents are there.
+			for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+				art.dirs[dir] = true
+			}
+		}
+	}
+	return art, nil
+}
@@ -0,0 +1,241 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/yaml"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+// tarball makes a gzipped tarball of the files given. Like those
+// from source-controller, it has no entries for directories.
+func tarball(g Gomega, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, name := range sortedKeys(files) {
+		g.Expect(tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+		})).To(Succeed())
+		_, err := tw.Write([]byte(files[name]))
+		g.Expect(err).NotTo(HaveOccurred())
+	}
+	g.Expect(tw.Close()).To(Succeed())
+	g.Expect(gz.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+func newSource(kind, name string, status map[string]interface{}) client.Object {
+	obj := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": defaultSourceAPIVersion,
+		"kind":       kind,
+		"metadata": map[string]interface{}{
+			"namespace": "default",
+			"name":      name,
+		},
+	}}
+	if status != nil {
+		obj.Object["status"] = status
+	}
+	return obj
+}
+
+func Test_source(t *testing.T) {
+	g := NewWithT(t)
+
+	data := tarball(g, map[string]string{
+		"apps/foo/config.yaml": "name: foo\n",
+		"apps/bar/config.yaml": "name: bar\n",
+		"README.md":            "# Apps\n",
+	})
+	sum := sha256.Sum256(data)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	// compresses very well, but unpacks to more than the limit
+	bomb := tarball(g, map[string]string{
+		"zeros": strings.Repeat("\x00", 1<<20),
+	})
+	bombSum := sha256.Sum256(bomb)
+
+	var fetches int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		if r.URL.Path == "/bomb.tar.gz" {
+			w.Write(bomb)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	artifactAt := func(path, digest string) map[string]interface{} {
+		return map[string]interface{}{
+			"artifact": map[string]interface{}{
+				"url":    server.URL + path,
+				"digest": digest,
+			},
+		}
+	}
+	artifact := func(digest string) map[string]interface{} {
+		return artifactAt("/artifact.tar.gz", digest)
+	}
+	k8sClient := fake.NewClientBuilder().WithObjects(
+		newSource("GitRepository", "apps", artifact(digest)),
+		newSource("Bucket", "corrupt", artifact("sha256:0000")),
+		newSource("Bucket", "md5", artifact("md5:0000")),
+		newSource("Bucket", "bomb", artifactAt("/bomb.tar.gz", "sha256:"+hex.EncodeToString(bombSum[:]))),
+		newSource("OCIRepository", "pending", nil),
+	).Build()
+	newEval := func() *Evaluator {
+		return &Evaluator{Client: k8sClient, Namespace: "default"}
+	}
+
+	t.Run("generates directories", func(t *testing.T) {
+		g := NewWithT(t)
+		ev := newEval()
+		expectGeneratorItems(g, `
+source:
+  kind: GitRepository
+  name: apps
+  directories: ["apps/*"]
+`, ev, Equal([]interface{}{
+			map[string]interface{}{"path": "apps/bar", "name": "bar"},
+			map[string]interface{}{"path": "apps/foo", "name": "foo"},
+		}))
+		g.Expect(ev.Queries()).To(HaveLen(1))
+		g.Expect(ev.Queries()[0].Matches(newSource("GitRepository", "apps", nil))).To(BeTrue())
+	})
+
+	t.Run("generates decoded files", func(t *testing.T) {
+		g := NewWithT(t)
+		expectGeneratorItems(g, `
+source:
+  kind: GitRepository
+  name: apps
+  files: ["*/*/config.yaml", "*.md"]
+`, newEval(), Equal([]interface{}{
+			map[string]interface{}{"path": "README.md", "name": "README.md", "content": "# Apps\n"},
+			map[string]interface{}{"path": "apps/bar/config.yaml", "name": "config.yaml", "content": map[string]interface{}{"name": "bar"}},
+			map[string]interface{}{"path": "apps/foo/config.yaml", "name": "config.yaml", "content": map[string]interface{}{"name": "foo"}},
+		}))
+	})
+
+	t.Run("fetches the artifact once per evaluation", func(t *testing.T) {
+		g := NewWithT(t)
+		ev := newEval()
+		var spec generate.Generator
+		g.Expect(yaml.Unmarshal([]byte(`
+source:
+  kind: GitRepository
+  name: apps
+  directories: ["*"]
+`), &spec)).To(Succeed())
+		gen, err := compileGenerator(&env{}, &spec)
+		g.Expect(err).NotTo(HaveOccurred())
+		before := fetches
+		for i := 0; i < 3; i++ {
+			_, err := gen(ev, map[string]interface{}{})
+			g.Expect(err).NotTo(HaveOccurred())
+		}
+		g.Expect(fetches - before).To(Equal(1))
+	})
+
+	t.Run("fails when the digest doesn't match", func(t *testing.T) {
+		g := NewWithT(t)
+		err := expectGeneratorError(g, `
+source:
+  kind: Bucket
+  name: corrupt
+  directories: ["*"]
+`, newEval())
+		g.Expect(err.Error()).To(ContainSubstring("digest mismatch"))
+	})
+
+	t.Run("fails, but records the query, when there's no artifact", func(t *testing.T) {
+		for _, name := range []string{"pending", "missing"} {
+			g := NewWithT(t)
+			ev := newEval()
+			expectGeneratorError(g, `
+source:
+  kind: OCIRepository
+  name: `+name+`
+  directories: ["*"]
+`, ev)
+			g.Expect(ev.Queries()).To(HaveLen(1))
+		}
+	})
+
+	t.Run("fails on an unknown digest algorithm", func(t *testing.T) {
+		g := NewWithT(t)
+		err := expectGeneratorError(g, `
+source:
+  kind: Bucket
+  name: md5
+  directories: ["*"]
+`, newEval())
+		g.Expect(err.Error()).To(ContainSubstring(`unsupported digest algorithm "md5"`))
+	})
+
+	t.Run("fails when the unpacked artifact is too big", func(t *testing.T) {
+		g := NewWithT(t)
+		ev := newEval()
+		ev.MaxBodySize = 64 << 10
+		g.Expect(int64(len(bomb))).To(BeNumerically("<", ev.MaxBodySize))
+		err := expectGeneratorError(g, `
+source:
+  kind: Bucket
+  name: bomb
+  files: ["*"]
+`, ev)
+		g.Expect(err.Error()).To(ContainSubstring("exceeds the limit"))
+	})
+
+	t.Run("follows the egress policy", func(t *testing.T) {
+		g := NewWithT(t)
+		policy, err := NewEgressPolicy(nil, []string{"127.0.0.0/8", "::1/128"})
+		g.Expect(err).NotTo(HaveOccurred())
+		ev := newEval()
+		ev.Egress = policy
+		err = expectGeneratorError(g, `
+source:
+  kind: GitRepository
+  name: apps
+  directories: ["*"]
+`, ev)
+		var egressErr *EgressError
+		g.Expect(errors.As(err, &egressErr)).To(BeTrue())
+	})
+}
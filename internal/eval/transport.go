@@ -0,0 +1,184 @@
+/*
+Copyright 2023 Michael Bridgen.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package eval
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	generate "github.com/squaremo/comprehension-controller/api/v1alpha1"
+)
+
+// httpClient gives the client for requests that need no TLS or proxy
+// settings of their own, which follows the egress policy if there is
+// one.
+func (ev *Evaluator) httpClient() *http.Client {
+	if ev.Egress != nil {
+		return ev.Egress.sharedClient()
+	}
+	return http.DefaultClient
+}
+
+// httpClientFor gives an HTTP client for making the requests of the
+// request generator given. If the request generator has no TLS or
+// proxy settings, this is a client shared with other request
+// generators; otherwise, it's a client with its own transport, and
+// `own` is true.
+func (ev *Evaluator) httpClientFor(request *generate.HttpRequest) (client *http.Client, own bool, err error) {
+	if request.TLS == nil && request.Proxy == "" {
+		return ev.httpClient(), false, nil
+	}
+
+	var transport *http.Transport
+	if ev.Egress != nil {
+		transport = ev.Egress.transport()
+	} else {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	if request.Proxy != "" {
+		proxyURL, err := url.Parse(request.Proxy)
+		if err != nil {
+			// the error would include the URL, which may have
+			// credentials in it, so don't wrap it.
+			return nil, false, fmt.Errorf("cannot parse proxy URL")
+		}
+		// Otherwise the proxy could be used to reach anywhere.
+		if err := ev.Egress.checkURL(proxyURL); err != nil {
+			return nil, false, err
+		}
+		// The proxy connects to the host, so the host's addresses
+		// must be checked here instead.
+		policy := ev.Egress
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if err := policy.checkHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			return proxyURL, nil
+		}
+	}
+	if request.TLS != nil {
+		tlsConfig, err := ev.tlsConfig(request.TLS)
+		if err != nil {
+			return nil, false, err
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+	client = &http.Client{Transport: transport}
+	if ev.Egress != nil {
+		client.CheckRedirect = ev.Egress.checkRedirect
+	}
+	return client, true, nil
+}
+
+// transportIdentity gives a string that identifies the credentials,
+// certificates, and proxy used by the request generator given. Since
+// secrets and configmaps are referred to by name, the namespace is
+// part of it too.
+func (ev *Evaluator) transportIdentity(request *generate.HttpRequest) string {
+	if request.Auth == nil && request.TLS == nil && request.Proxy == "" {
+		return ""
+	}
+	var id strings.Builder
+	id.WriteString(ev.Namespace)
+	write := func(field, value string) {
+		fmt.Fprintf(&id, "\x00%s=%s", field, value)
+	}
+	if request.Auth != nil {
+		write("auth", request.Auth.SecretRef.Name)
+	}
+	if tls := request.TLS; tls != nil {
+		if tls.SecretRef != nil {
+			write("tls.secret", tls.SecretRef.Name)
+		}
+		if tls.CAConfigMapRef != nil {
+			write("tls.configmap", tls.CAConfigMapRef.Name)
+		}
+		write("tls.serverName", tls.ServerName)
+	}
+	if request.Proxy != "" {
+		write("proxy", request.Proxy)
+	}
+	return id.String()
+}
+
+// tlsConfig constructs a TLS configuration from the certificates
+// referred to.
+func (ev *Evaluator) tlsConfig(spec *generate.TLSConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: spec.ServerName,
+	}
+
+	var caBundle []byte
+	if ref := spec.SecretRef; ref != nil {
+		var secret corev1.Secret
+		if err := ev.getLocalObject(ref.Name, &secret); err != nil {
+			return nil, fmt.Errorf("unable to fetch secret for TLS: %w", err)
+		}
+		caBundle = append(caBundle, secret.Data["ca.crt"]...)
+
+		certPEM, keyPEM := secret.Data["tls.crt"], secret.Data["tls.key"]
+		switch {
+		case len(certPEM) > 0 && len(keyPEM) > 0:
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("cannot load client certificate from secret %q: %w", ref.Name, err)
+			}
+			config.Certificates = []tls.Certificate{cert}
+		case len(certPEM) > 0 || len(keyPEM) > 0:
+			return nil, fmt.Errorf("secret %q must have both tls.crt and tls.key, or neither", ref.Name)
+		}
+	}
+
+	if ref := spec.CAConfigMapRef; ref != nil {
+		var cm corev1.ConfigMap
+		if err := ev.getLocalObject(ref.Name, &cm); err != nil {
+			return nil, fmt.Errorf("unable to fetch configmap for TLS: %w", err)
+		}
+		// The bundle from the secret may not end with a newline,
+		// in which case the first certificate here wouldn't be
+		// parsed.
+		if len(caBundle) > 0 {
+			caBundle = append(caBundle, '\n')
+		}
+		if ca, ok := cm.Data["ca.crt"]; ok {
+			caBundle = append(caBundle, ca...)
+		} else {
+			caBundle = append(caBundle, cm.BinaryData["ca.crt"]...)
+		}
+	}
+
+	if len(caBundle) > 0 {
+		// The CA bundle is in addition to the usual roots, so
+		// that e.g., a proxy with a public certificate can still
+		// be verified.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, fmt.Errorf("no certificates could be parsed from the CA bundle")
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
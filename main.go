@@ -19,20 +19,25 @@ package main
 import (
 	"flag"
 	"os"
+	"strings"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	generatev1alpha1 "github.com/squaremo/comprehension-controller/api/v1alpha1"
 	"github.com/squaremo/comprehension-controller/controllers"
+	"github.com/squaremo/comprehension-controller/internal/eval"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -52,11 +57,28 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var responseCacheSize int
+	var egressAllowedHosts, egressDeniedCIDRs string
+	var maxBodySize string
+	var maxItems int
+	var crossNamespaceQueries string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&responseCacheSize, "response-cache-size", 1000,
+		"The number of HTTP responses to keep for revalidating with conditional requests. Zero disables the cache.")
+	flag.StringVar(&egressAllowedHosts, "egress-allowed-hosts", "",
+		"Comma-separated patterns (e.g., '*.example.com') for the hosts request generators may fetch from. If empty, any host is allowed.")
+	flag.StringVar(&egressDeniedCIDRs, "egress-denied-cidrs", "",
+		"Comma-separated IP ranges (e.g., '169.254.0.0/16,10.0.0.0/8') request generators may not connect to.")
+	flag.StringVar(&maxBodySize, "max-response-body-size", "50Mi",
+		"The largest response body any request generator may read, whatever it asks for. Zero means no limit beyond the request generator's own.")
+	flag.IntVar(&maxItems, "max-generator-items", 0,
+		"The most values any request or range generator may generate, whatever it asks for. Zero means no limit beyond the request generator's own, and 10000 for range generators.")
+	flag.StringVar(&crossNamespaceQueries, "cross-namespace-queries", "",
+		"Comma-separated namespaces in which comprehensions may query objects in other namespaces; '*' means any namespace. If empty, queries are confined to the comprehension's own namespace.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -72,6 +94,10 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "b31462e9.squaremo.dev",
+		// Secrets are read as needed, from the comprehension's
+		// namespace, rather than every Secret in the cluster being
+		// kept in memory.
+		ClientDisableCacheFor: []client.Object{&corev1.Secret{}},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -89,9 +115,34 @@ func main() {
 		os.Exit(1)
 	}
 
+	var responseCache *eval.ResponseCache
+	if responseCacheSize > 0 {
+		responseCache = eval.NewResponseCache(responseCacheSize)
+	}
+
+	var egress *eval.EgressPolicy
+	if egressAllowedHosts != "" || egressDeniedCIDRs != "" {
+		egress, err = eval.NewEgressPolicy(splitList(egressAllowedHosts), splitList(egressDeniedCIDRs))
+		if err != nil {
+			setupLog.Error(err, "invalid egress policy")
+			os.Exit(1)
+		}
+	}
+
+	maxBodySizeQuantity, err := resource.ParseQuantity(maxBodySize)
+	if err != nil {
+		setupLog.Error(err, "invalid --max-response-body-size")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.ComprehensionReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                mgr.GetClient(),
+		Scheme:                mgr.GetScheme(),
+		ResponseCache:         responseCache,
+		Egress:                egress,
+		MaxBodySize:           maxBodySizeQuantity.Value(),
+		MaxItems:              maxItems,
+		CrossNamespaceQueries: splitList(crossNamespaceQueries),
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Comprehension")
 		os.Exit(1)
@@ -113,3 +164,15 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma-separated flag value, ignoring empty
+// entries.
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			result = append(result, item)
+		}
+	}
+	return result
+}